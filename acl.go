@@ -0,0 +1,139 @@
+// Copyright © 2020 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// The ACL files are one CIDR prefix or bare address per line, with `#` for
+// comments.  A deny match always wins.  If an allow file is configured then
+// clients must match it; until it has been loaded, nobody matches, so we fail
+// closed.  Like the alias file, a failed reload keeps the previous list.
+//
+// Clients on unix-domain sockets are not subject to these lists.  Trusted
+// PROXY-protocol peers are not checked themselves, the clients they name are.
+var aclOpts struct {
+	allowFile string
+	denyFile  string
+}
+
+func init() {
+	flag.StringVar(&aclOpts.allowFile, "acl.allow-file", "", "file of client CIDRs to permit; if set, all others are denied")
+	flag.StringVar(&aclOpts.denyFile, "acl.deny-file", "", "file of client CIDRs to deny")
+}
+
+type aclRule struct {
+	prefix netip.Prefix
+	// where is file:line, for logging which rule matched
+	where string
+}
+
+var clientACL struct {
+	sync.RWMutex
+	allow []aclRule
+	deny  []aclRule
+}
+
+// checkClientACL returns false if the client should be refused, with the
+// rule responsible.
+func checkClientACL(client net.Addr) (bool, string) {
+	if aclOpts.allowFile == "" && aclOpts.denyFile == "" {
+		return true, ""
+	}
+	ip, ok := addrToNetip(client)
+	if !ok {
+		return true, ""
+	}
+	clientACL.RLock()
+	defer clientACL.RUnlock()
+	for _, r := range clientACL.deny {
+		if r.prefix.Contains(ip) {
+			return false, "deny " + r.prefix.String() + " at " + r.where
+		}
+	}
+	if aclOpts.allowFile == "" {
+		return true, ""
+	}
+	for _, r := range clientACL.allow {
+		if r.prefix.Contains(ip) {
+			return true, ""
+		}
+	}
+	return false, "not in allow-list " + aclOpts.allowFile
+}
+
+func loadAllowList(log logrus.FieldLogger) {
+	if rules, ok := loadACLFile(aclOpts.allowFile, log.WithField("acl", "allow")); ok {
+		clientACL.Lock()
+		clientACL.allow = rules
+		clientACL.Unlock()
+	}
+}
+
+func loadDenyList(log logrus.FieldLogger) {
+	if rules, ok := loadACLFile(aclOpts.denyFile, log.WithField("acl", "deny")); ok {
+		clientACL.Lock()
+		clientACL.deny = rules
+		clientACL.Unlock()
+	}
+}
+
+func loadACLFile(filename string, log logrus.FieldLogger) ([]aclRule, bool) {
+	log = log.WithField("file", filename)
+	fh, err := os.Open(filename)
+	if err != nil {
+		log.WithError(err).Warn("unable to load ACL")
+		return nil, false
+	}
+	defer fh.Close()
+
+	rules := make([]aclRule, 0, 32)
+	r := bufio.NewReader(fh)
+	var line string
+	for lineNum := 0; err != io.EOF; {
+		line, err = r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			log.WithError(err).Warn("problem reading ACL, aborting")
+			return nil, false
+		}
+		lineNum++
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		p, perr := parsePrefixOrAddr(line)
+		if perr != nil {
+			log.WithError(perr).WithField("line", lineNum).Warn("malformed line, skipping")
+			continue
+		}
+		rules = append(rules, aclRule{prefix: p, where: fmt.Sprintf("%s:%d", filename, lineNum)})
+	}
+
+	log.WithField("rule-count", len(rules)).Info("parsed ACL")
+	return rules, true
+}
+
+func scheduleAutoACLReload(log logrus.FieldLogger) {
+	if aclOpts.allowFile != "" {
+		watchFileForChanges(aclOpts.allowFile, log, loadAllowList)
+	}
+	if aclOpts.denyFile != "" {
+		watchFileForChanges(aclOpts.denyFile, log, loadDenyList)
+	}
+}
@@ -6,17 +6,17 @@ package main
 
 import (
 	"bufio"
+	"fmt"
 	"io"
 	"os"
-	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 
 	"github.com/sirupsen/logrus"
-	"gopkg.in/fsnotify.v1"
 )
 
-// opts.aliasfile defaults to /etc/finger.conf
+// The alias-file setting defaults to /etc/finger.conf
 // The format is man-page specified on BSD; "#" for comments, nothing about blank lines;
 // Unix tradition, expect a final newline
 // all real lines are:
@@ -26,44 +26,183 @@ import (
 // stick to that constraint.
 // Also aliases can be fully-qualified filenames (start with a `/`) to point elsewhere.
 
+// Each alias file in use, by the top-level settings or a namespace, has its
+// own table, keyed by filename, so that namespaces sharing a file share the
+// table.
+type aliasTable struct {
+	filename     string
+	to           map[string]string
+	stopWatching func()
+}
+
 var aliases struct {
 	sync.RWMutex
-	to map[string]string
+	tables map[string]*aliasTable
 }
 
 func init() {
-	aliases.to = make(map[string]string)
+	aliases.tables = make(map[string]*aliasTable)
 }
 
-func currentAliases() map[string]string {
+// aliasesFor returns the aliases from filename; it's empty if the file is
+// not loaded.
+func aliasesFor(filename string) map[string]string {
 	aliases.RLock()
 	defer aliases.RUnlock()
-	return aliases.to
+	if t, ok := aliases.tables[filename]; ok {
+		return t.to
+	}
+	return nil
 }
 
-func loadMappingData(log logrus.FieldLogger) {
-	log = log.WithField("file", opts.aliasfile)
+// loadAliasFile replaces the table for filename, if it's been set up by
+// syncAliasFiles (or created, if create is true); a file which can't be
+// read leaves any current table alone.
+func loadAliasFile(filename string, create bool, log logrus.FieldLogger) {
+	log = log.WithField("file", filename)
 	var err error
-	fh, err := os.Open(opts.aliasfile)
+	fh, err := os.Open(filename)
 	if err != nil {
 		log.WithError(err).Info("unable to load aliases")
+		metricAliasReloads.WithLabelValues("failure").Inc()
+		if os.IsNotExist(err) {
+			healthSetAliasState(filename, aliasStateAbsent)
+		} else {
+			healthSetAliasState(filename, aliasStateError)
+		}
 		return
 	}
 	defer fh.Close()
 
-	concrete := make(map[string]string)
+	// No size limit on the alias file, we "trust" it
+	concrete, _, problems, err := parseAliases(fh)
+	if err != nil {
+		log.WithError(err).Warn("problem reading config, aborting")
+		metricAliasReloads.WithLabelValues("failure").Inc()
+		healthSetAliasState(filename, aliasStateError)
+		return
+	}
+	for _, p := range problems {
+		log.WithField("line", p.line).Warn(p.msg)
+	}
+
+	aliases.Lock()
+	t, ok := aliases.tables[filename]
+	if !ok && create {
+		t = &aliasTable{filename: filename}
+		aliases.tables[filename] = t
+	}
+	if t != nil {
+		t.to = concrete
+	}
+	aliases.Unlock()
+	if t == nil {
+		// dropped by a reload while we were reading
+		return
+	}
+	log.WithField("alias-count", len(concrete)).Info("parsed aliases")
+	metricAliasReloads.WithLabelValues("success").Inc()
+	metricAliasCount.Set(float64(aliasCount()))
+	healthSetAliasState(filename, aliasStateLoaded)
+}
+
+// aliasCount is the total over all tables.
+func aliasCount() int {
+	aliases.RLock()
+	defer aliases.RUnlock()
+	total := 0
+	for _, t := range aliases.tables {
+		total += len(t.to)
+	}
+	return total
+}
 
-	unresolved := make([][2]string, 0, 100)
+// syncAliasFiles makes the alias tables match the current settings: files
+// no longer used are dropped and no longer watched; new files are loaded
+// and, if watch is true, watched; files still in use are re-read, as a
+// manual fallback for when file-watching isn't working.
+//
+// As long as the _directory_ exists, we'll detect a late file creation and
+// handle it fine.
+func syncAliasFiles(log logrus.FieldLogger, watch bool) {
+	wanted := currentSettings().aliasFiles()
+	keep := make(map[string]bool, len(wanted))
+	for _, f := range wanted {
+		keep[f] = true
+	}
 
-	// No size limit on the alias file, we "trust" it
-	r := bufio.NewReader(fh)
-	err = nil
+	var added, existing []string
+	aliases.Lock()
+	for name, t := range aliases.tables {
+		if keep[name] {
+			existing = append(existing, name)
+			continue
+		}
+		if t.stopWatching != nil {
+			t.stopWatching()
+			healthForgetWatcher(name)
+		}
+		delete(aliases.tables, name)
+		healthForgetAliasFile(name)
+	}
+	for _, f := range wanted {
+		if _, ok := aliases.tables[f]; !ok {
+			aliases.tables[f] = &aliasTable{filename: f, to: make(map[string]string)}
+			healthSetAliasState(f, aliasStatePending)
+			added = append(added, f)
+		}
+	}
+	aliases.Unlock()
+
+	for _, f := range existing {
+		loadAliasFile(f, false, log)
+	}
+	for _, f := range added {
+		loadAliasFile(f, false, log)
+		if !watch {
+			continue
+		}
+		stop := watchFileForChanges(f, log, func(log logrus.FieldLogger) {
+			loadAliasFile(f, false, log)
+		})
+		aliases.Lock()
+		if t, ok := aliases.tables[f]; ok {
+			t.stopWatching = stop
+			stop = nil
+		}
+		aliases.Unlock()
+		if stop != nil {
+			stop()
+			healthForgetWatcher(f)
+		}
+	}
+	metricAliasCount.Set(float64(aliasCount()))
+}
+
+// aliasProblem is something in the alias file which we skip past or which
+// won't do what its author probably intended.
+type aliasProblem struct {
+	line int
+	msg  string
+}
+
+// parseAliases applies the rules described at the top of this file; lines
+// gives where each alias in concrete was defined.  The problems are not
+// fatal, they are logged when loading and reported by `check`.
+func parseAliases(rd io.Reader) (concrete map[string]string, lines map[string]int, problems []aliasProblem, err error) {
+	type entry struct {
+		from, to string
+		line     int
+	}
+	unresolved := make([]entry, 0, 100)
+	defined := make(map[string]bool)
+
+	r := bufio.NewReader(rd)
 	var line string
 	for lineNum := 0; err != io.EOF; {
 		line, err = r.ReadString('\n')
 		if err != nil && err != io.EOF {
-			log.WithError(err).Warn("problem reading config, aborting")
-			return
+			return nil, nil, nil, err
 		}
 		lineNum++
 		line = strings.TrimSpace(line)
@@ -72,132 +211,38 @@ func loadMappingData(log logrus.FieldLogger) {
 		}
 		fields := strings.SplitN(line, ":", 2)
 		if len(fields) != 2 || len(fields[0]) == 0 || len(fields[1]) == 0 || strings.ContainsRune(fields[0], '/') {
-			log.WithField("line", lineNum).Warn("malformed line, skipping")
+			problems = append(problems, aliasProblem{lineNum, "malformed line, skipping"})
 			continue
 		}
 
-		unresolved = append(unresolved, [2]string{fields[0], fields[1]})
-	}
-
-	for i := len(unresolved) - 1; i >= 0; i-- {
-		from := strings.ToLower(unresolved[i][0])
-		to := unresolved[i][1]
+		from := strings.ToLower(fields[0])
+		to := fields[1]
 		if to[0] != '/' {
 			to = strings.ToLower(to)
 		}
-		if _, ok := concrete[from]; ok {
-			log.Warn("alias %q defined more than once, last one wins", from)
-			continue
-		}
-		if chain, ok := concrete[to]; ok {
-			concrete[from] = chain
-		} else {
-			concrete[from] = to
-		}
+		unresolved = append(unresolved, entry{from, to, lineNum})
+		defined[from] = true
 	}
 
-	aliases.Lock()
-	aliases.to = concrete
-	aliases.Unlock()
-	log.WithField("alias-count", len(concrete)).Info("parsed aliases")
-}
-
-// as long as the _directory_ exists, we'll detect a late file creation and handle it fine.
-func scheduleAutoMappingDataReload(log logrus.FieldLogger) {
-	log = log.WithField("subsystem", "fs-watcher")
-	// originally mostly ripped straight from fsnotify.v1's NewWatcher example in the docs
-	watcher, err := fsnotify.NewWatcher()
-	if err != nil {
-		log.WithError(err).Error("unable to start FS watcher, will not detect changes")
-		// We continue on without aborting
-		return
-	}
-	logrus.RegisterExitHandler(func() { _ = watcher.Close() })
-
-	basename := filepath.Base(opts.aliasfile)
-	dirname := filepath.Dir(opts.aliasfile)
-
-	go func() {
-		for {
-			select {
-			case event, ok := <-watcher.Events:
-				if !ok {
-					log.Warn("terminating config-watcher event dispatcher")
-					return
-				}
-				l := log.WithField("event", event)
-				switch filepath.Base(event.Name) {
-				case basename:
-					if event.Op&fsnotify.Write == fsnotify.Write {
-						l.Info("modification detected")
-						// The actual work!  (also in some other edge-cases just below)
-						loadMappingData(log)
-					} else if event.Op&fsnotify.Create == fsnotify.Create {
-						// better late than never
-						l.Info("creation detected (adding watch)")
-						loadMappingData(log)
-						watcher.Add(opts.aliasfile)
-					} else if event.Op&fsnotify.Chmod == fsnotify.Chmod {
-						// assume file created with 0 permissions then chmod'd more open, so our initial read might
-						// have failed.  Should be harmless to re-read the file.  If it was chmod'd unreadable, we'll
-						// error out cleanly.
-						l.Info("chmod detected")
-						loadMappingData(log)
-					} else if event.Op&fsnotify.Remove == fsnotify.Remove || event.Op&fsnotify.Rename == fsnotify.Rename {
-						// I have seen this fire when the watched config file
-						// is an entry in a K8S configmap and the entry was
-						// modified, not deleted.
-						_, err := os.Stat(event.Name)
-						if err != nil && os.IsNotExist(err) {
-							l.Info("file gone, confirmed, WATCH GONE")
-						} else {
-							l.Info("file gone, false positive, file still exists, re-watching")
-							// The kernel will have removed the watch and
-							// fsnotify will have removed its copy, to match.
-							// We can't just ignore this, we have to add the
-							// watch back.
-							watcher.Add(opts.aliasfile)
-						}
-						// TODO: should we also remove all aliases?
-						// We currently continue running with the last aliases seen, which lets us
-						// steady-state on the assumption that the file is being replaced.  Perhaps
-						// we should start a timer and after 5 seconds, nuke the loaded aliases?
-					}
-					// no other scenarios known
-				case dirname:
-					// usually ...
-					// nothing to do; file creation will create an event named for the file, which we detect above for the file
-					// which we care about; chmod ... we care less about.
-					if event.Op&fsnotify.Remove == fsnotify.Remove || event.Op&fsnotify.Rename == fsnotify.Rename {
-						l.Warn("directory of config file gone, nuking watcher, no notifications anymore")
-						// duplicate close on shutdown is safe
-						_ = watcher.Close()
-						return
-					}
-				}
-			case err, ok := <-watcher.Errors:
-				if !ok {
-					log.Warn("terminating config-watcher event dispatcher")
-					return
-				}
-				log.WithError(err).Warn("error")
-			}
+	concrete = make(map[string]string)
+	lines = make(map[string]int)
+	for i := len(unresolved) - 1; i >= 0; i-- {
+		e := unresolved[i]
+		if _, ok := concrete[e.from]; ok {
+			problems = append(problems, aliasProblem{e.line, fmt.Sprintf("alias %q defined more than once, last one (line %d) wins", e.from, lines[e.from])})
+			continue
 		}
-	}()
-
-	count := 0
-	for _, p := range []string{opts.aliasfile, dirname} {
-		err = watcher.Add(p)
-		if err != nil {
-			log.WithError(err).WithField("file", p).Info("unable to start watching")
-			// do not error out
+		lines[e.from] = e.line
+		if chain, ok := concrete[e.to]; ok {
+			concrete[e.from] = chain
 		} else {
-			count++
+			if defined[e.to] {
+				problems = append(problems, aliasProblem{e.line, fmt.Sprintf("alias %q points back to alias %q, which is only defined earlier; treating %q as a user", e.from, e.to, e.to)})
+			}
+			concrete[e.from] = e.to
 		}
 	}
-
-	if count == 0 {
-		log.Warn("unable to set up any watches, terminating FS watcher, auto-reloading gone")
-		_ = watcher.Close()
-	}
+	// We walked backwards, so put problems back into file order.
+	sort.SliceStable(problems, func(i, j int) bool { return problems[i].line < problems[j].line })
+	return concrete, lines, problems, nil
 }
@@ -0,0 +1,181 @@
+// Copyright © 2020 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// The check subcommand validates the configuration and alias files offline,
+// for CI or before deploying an edit: `fingerd check [alias-file]`, where an
+// alias-file given replaces only the top-level one, not namespaces'.  It
+// resolves users the way the daemon would, so should be run as the user the
+// daemon runs as, on the same host (or at least with the same homes).  Exit
+// code is 1 if there are problems, 2 if we couldn't check at all.
+
+func init() {
+	subcommands["check"] = checkMain
+}
+
+func checkMain(args []string) int {
+	if len(args) > 1 {
+		fmt.Fprintf(os.Stderr, "%s check: usage: check [alias-file]\n", fingerProgram)
+		return 2
+	}
+
+	cfg := *currentSettings()
+	if len(args) == 1 {
+		cfg.aliasFile = args[0]
+	}
+
+	problems := 0
+	report := func(where, msg string) {
+		fmt.Printf("%s: %s\n", where, msg)
+		problems++
+	}
+
+	var namespaces []namespace
+	if err := cfg.validate(); err != nil {
+		for _, line := range strings.Split(err.Error(), "\n") {
+			report("settings", line)
+		}
+	} else if full, err := buildSettings(); err != nil {
+		// the namespaces, since the top-level settings passed
+		report("config", err.Error())
+	} else {
+		namespaces = full.namespaces
+	}
+	if err := setupLDAP(); err != nil {
+		report("ldap", err.Error())
+	}
+	if err := checkForwardOpts(); err != nil {
+		report("forward", err.Error())
+	}
+
+	if !checkLookupSettings(&cfg, "", report) {
+		return 2
+	}
+	for _, ns := range namespaces {
+		if !checkLookupSettings(ns.cfg, "namespace "+ns.name+": ", report) {
+			return 2
+		}
+	}
+
+	if problems > 0 {
+		fmt.Printf("FAIL: %d problems\n", problems)
+		return 1
+	}
+	fmt.Println("ok")
+	return 0
+}
+
+// checkLookupSettings checks the paths which the user lookups use; it
+// returns false only if the alias file could not be read at all.
+func checkLookupSettings(cfg *settings, label string, report func(where, msg string)) bool {
+	if cfg.homesDir != "" {
+		if fi, err := os.Stat(cfg.homesDir); err != nil {
+			report(label+"homes-dir", err.Error())
+		} else if !fi.IsDir() {
+			report(label+"homes-dir", fmt.Sprintf("%q is not a directory", cfg.homesDir))
+		}
+	}
+
+	for _, vh := range cfg.virtualHomes {
+		if fi, err := os.Stat(vh.dir); err != nil {
+			report(label+"virtual-home", err.Error())
+		} else if !fi.IsDir() {
+			report(label+"virtual-home", fmt.Sprintf("%q is not a directory", vh.dir))
+		}
+	}
+
+	if cfg.aliasFile == "" {
+		fmt.Printf("%salias-file: disabled, not checked\n", label)
+		return true
+	}
+	n, ok := checkAliasFile(cfg, report)
+	if ok {
+		fmt.Printf("%s%s: %d aliases\n", label, cfg.aliasFile, n)
+	}
+	return ok
+}
+
+// checkAliasFile returns false only if the file could not be read at all.
+func checkAliasFile(cfg *settings, report func(where, msg string)) (count int, ok bool) {
+	fh, err := os.Open(cfg.aliasFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s check: %v\n", fingerProgram, err)
+		return 0, false
+	}
+	defer fh.Close()
+
+	concrete, lines, problems, err := parseAliases(fh)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s check: %s: %v\n", fingerProgram, cfg.aliasFile, err)
+		return 0, false
+	}
+	for _, p := range problems {
+		report(fmt.Sprintf("%s:%d", cfg.aliasFile, p.line), p.msg)
+	}
+
+	// The user lookups log at Info when they hit something odd, which is
+	// noise here; we report what matters ourselves.
+	logger := logrus.New()
+	logger.Out = os.Stderr
+	logger.SetLevel(logrus.WarnLevel)
+
+	if passwdIndexWanted() {
+		loadPasswdIndex(logger)
+	}
+
+	names := make([]string, 0, len(concrete))
+	for from := range concrete {
+		names = append(names, from)
+	}
+	sort.Slice(names, func(i, j int) bool { return lines[names[i]] < lines[names[j]] })
+
+	for _, from := range names {
+		to := concrete[from]
+		where := fmt.Sprintf("%s:%d", cfg.aliasFile, lines[from])
+		if to[0] == '/' {
+			if msg := checkStaticFile(cfg, to); msg != "" {
+				report(where, fmt.Sprintf("alias %q: %s", from, msg))
+			}
+			continue
+		}
+		// No alias tables are loaded in this process, so this is just the
+		// user lookup.
+		if _, found := findUser(cfg, to, logger.WithField("alias", from)); !found {
+			report(where, fmt.Sprintf("alias %q: target user %q not found", from, to))
+		}
+	}
+	return len(concrete), true
+}
+
+// checkStaticFile mirrors the conditions under which sendFile pretends that
+// a file does not exist.
+func checkStaticFile(cfg *settings, filename string) string {
+	fh, err := os.Open(filename)
+	if err != nil {
+		return err.Error()
+	}
+	defer fh.Close()
+	fi, err := fh.Stat()
+	switch {
+	case err != nil:
+		return err.Error()
+	case fi.Mode()&os.ModeType != 0:
+		return fmt.Sprintf("static file %q is not a regular file", filename)
+	case fi.Size() == 0:
+		return fmt.Sprintf("static file %q is empty", filename)
+	case fi.Size() > cfg.fileSizeLimit:
+		return fmt.Sprintf("static file %q too large (%d > file.size-limit %d)", filename, fi.Size(), cfg.fileSizeLimit)
+	}
+	return ""
+}
@@ -0,0 +1,214 @@
+// Copyright © 2020 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// The client subcommand is an RFC 1288 finger client, so that we have one
+// which behaves the same everywhere:
+//
+//	fingerd client [flags] [/W] [user]@host[:port]...
+//
+// As per the RFC, `user@host1@host2` asks host2 to forward to host1; we
+// split at the last `@`.  The request is sent with CRLF, and replies may
+// use CRLF or bare LF, as with sendLine.  Control characters in the reply
+// are always escaped; -raw escapes the line terminators too, to show exactly
+// what was sent.
+//
+// These flags are our own, after the subcommand name, not the daemon's.
+
+const (
+	clientDefaultPort = "79"
+	// Far more than any sane server sends, but bounded.
+	clientMaxReply = 16 * 1024 * 1024
+	// How long -tls=auto waits for a TLS handshake before trying plain text.
+	clientAutoTLSWait = 3 * time.Second
+)
+
+const (
+	clientTLSOff  = "off"
+	clientTLSOn   = "on"
+	clientTLSAuto = "auto"
+)
+
+type clientOptions struct {
+	tlsMode     string
+	tlsInsecure bool
+	timeout     time.Duration
+	raw         bool
+	long        bool
+}
+
+func init() {
+	subcommands["client"] = clientMain
+}
+
+func clientMain(args []string) int {
+	var co clientOptions
+	fs := flag.NewFlagSet(fingerProgram+" client", flag.ContinueOnError)
+	fs.StringVar(&co.tlsMode, "tls", clientTLSOff, "use TLS: off, on, or auto (try TLS, fall back to plain if the handshake fails)")
+	fs.BoolVar(&co.tlsInsecure, "tls.insecure", false, "don't verify the server's TLS certificate")
+	fs.DurationVar(&co.timeout, "timeout", 10*time.Second, "overall timeout for each query")
+	fs.BoolVar(&co.raw, "raw", false, "show the reply exactly, with line terminators escaped too")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s client [flags] [/W] [user]@host[:port]...\n", fingerProgram)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	switch co.tlsMode {
+	case clientTLSOff, clientTLSOn, clientTLSAuto:
+	default:
+		fmt.Fprintf(os.Stderr, "%s client: unknown -tls mode %q\n", fingerProgram, co.tlsMode)
+		return 2
+	}
+
+	targets := fs.Args()
+	if len(targets) > 0 && (targets[0] == "/W" || targets[0] == "/w") {
+		co.long = true
+		targets = targets[1:]
+	}
+	if len(targets) == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	exit := 0
+	for i, target := range targets {
+		if i > 0 && !co.raw {
+			fmt.Println()
+		}
+		if err := clientQuery(target, &co, os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "%s client: %s: %v\n", fingerProgram, target, err)
+			exit = 1
+		}
+	}
+	return exit
+}
+
+// clientSplitTarget returns the request line (without terminator) and the
+// host:port to send it to.
+func clientSplitTarget(target string, long bool) (request, address string, err error) {
+	at := strings.LastIndexByte(target, '@')
+	if at < 0 {
+		return "", "", fmt.Errorf("no @host in %q", target)
+	}
+	request, host := target[:at], target[at+1:]
+	if host == "" {
+		return "", "", fmt.Errorf("empty host in %q", target)
+	}
+	if long {
+		if request == "" {
+			request = "/W"
+		} else {
+			request = "/W " + request
+		}
+	}
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		return request, net.JoinHostPort(h, p), nil
+	}
+	// A bare IPv6 address, perhaps in brackets without a port.
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	return request, net.JoinHostPort(host, clientDefaultPort), nil
+}
+
+func clientQuery(target string, co *clientOptions, out io.Writer) error {
+	request, address, err := clientSplitTarget(target, co.long)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(co.timeout)
+
+	conn, err := clientDial(address, co, deadline)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(request + "\r\n")); err != nil {
+		return fmt.Errorf("sending request: %w", err)
+	}
+
+	if !co.raw {
+		fmt.Fprintf(out, "[%s]\n", address)
+	}
+	r := bufio.NewReader(io.LimitReader(conn, clientMaxReply))
+	for {
+		line, err := r.ReadString('\n')
+		if line != "" {
+			if co.raw {
+				fmt.Fprintln(out, escapeText(line, true))
+			} else {
+				line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+				fmt.Fprintln(out, escapeText(line, false))
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading reply: %w", err)
+		}
+	}
+}
+
+// clientDial returns a connection with the deadline already set; in auto
+// mode, a failed TLS handshake is retried as plain text on a new connection,
+// but a certificate which doesn't verify is an error, not a reason to drop
+// to plain text.
+func clientDial(address string, co *clientOptions, deadline time.Time) (net.Conn, error) {
+	dial := func() (net.Conn, error) {
+		conn, err := net.DialTimeout("tcp", address, time.Until(deadline))
+		if err != nil {
+			return nil, err
+		}
+		_ = conn.SetDeadline(deadline)
+		return conn, nil
+	}
+
+	conn, err := dial()
+	if err != nil || co.tlsMode == clientTLSOff {
+		return conn, err
+	}
+
+	host, _, _ := net.SplitHostPort(address)
+	tc := tls.Client(conn, &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: co.tlsInsecure,
+		MinVersion:         tls.VersionTLS12,
+	})
+	if co.tlsMode == clientTLSAuto {
+		// A plain-text server will sit on our ClientHello waiting for a
+		// newline, so don't let that eat the whole timeout.
+		if hs := time.Now().Add(clientAutoTLSWait); hs.Before(deadline) {
+			_ = conn.SetDeadline(hs)
+		}
+	}
+	err = tc.Handshake()
+	if err == nil {
+		_ = conn.SetDeadline(deadline)
+		return tc, nil
+	}
+	_ = conn.Close()
+
+	var certErr *tls.CertificateVerificationError
+	if co.tlsMode == clientTLSOn || errors.As(err, &certErr) {
+		return nil, fmt.Errorf("TLS handshake: %w", err)
+	}
+	fmt.Fprintf(os.Stderr, "%s client: %s: no TLS (%v), falling back to plain text\n", fingerProgram, address, err)
+	return dial()
+}
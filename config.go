@@ -0,0 +1,355 @@
+// Copyright © 2020 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// The config file is TOML, or YAML if named *.yaml or *.yml; keys are the
+// flag names, with the dotted parts either as tables or quoted keys, so these
+// are equivalent:
+//
+//	[passwd]
+//	min-uid = 1000
+//
+//	"passwd.min-uid" = 1000
+//
+// and in YAML, `passwd: {min-uid: 1000}` or `passwd.min-uid: 1000`.
+//
+// Values may be given as native TOML types or as strings in the same syntax
+// as on the command-line (needed for durations: `read = "10s"`); flags which
+// take lists take arrays.
+//
+// Precedence, highest first: command-line flags, environment variables
+// (FINGERD_ then the flag name upper-cased with punctuation as underscores),
+// the config file, defaults.  Only the settings in settings.go are re-read
+// on SIGHUP; everything else in the file takes effect at startup only.
+
+const envConfigPrefix = "FINGERD_"
+
+// notConfigurable flags make no sense in a config file.
+var notConfigurable = map[string]bool{
+	"config":           true,
+	"print-config":     true,
+	"version":          true,
+	"listen.at-a-time": true,
+}
+
+func init() {
+	flag.StringVar(&opts.configFile, "config", "", "TOML (or .yaml/.yml) config file, keys are flag names (settings re-read on SIGHUP)")
+	flag.BoolVar(&opts.printConfig, "print-config", false, "show the effective configuration, as TOML, and exit")
+}
+
+// commandLineFlags records which flags were explicitly given on the
+// command-line, as those override the config file, even on reload.
+var commandLineFlags = make(map[string]bool)
+
+// configSources records, for -print-config, where each non-default value
+// came from.
+var configSources = make(map[string]string)
+
+func recordCommandLineFlags() {
+	flag.Visit(func(f *flag.Flag) {
+		commandLineFlags[f.Name] = true
+		configSources[f.Name] = "command-line"
+	})
+}
+
+// envNameForFlag gives the environment variable which can set a flag.
+func envNameForFlag(name string) string {
+	return envConfigPrefix + strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= '0' && r <= '9', r >= 'A' && r <= 'Z':
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// listValue is a flag which takes a list; setting it from the config file or
+// environment replaces the whole list, rather than adding to it as repeating
+// the flag on the command-line might.
+type listValue interface {
+	flag.Value
+	SetList([]string) error
+	List() []string
+}
+
+// envConfigValues returns the flag-name to value mapping from the
+// environment, for flags in fs.  List flags take one item per line.
+func envConfigValues(fs *flag.FlagSet) map[string][]string {
+	out := make(map[string][]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		if notConfigurable[f.Name] {
+			return
+		}
+		v, ok := os.LookupEnv(envNameForFlag(f.Name))
+		if !ok {
+			return
+		}
+		if _, isList := f.Value.(listValue); isList {
+			out[f.Name] = strings.Split(strings.TrimSuffix(v, "\n"), "\n")
+		} else {
+			out[f.Name] = []string{v}
+		}
+	})
+	return out
+}
+
+// applyStartupConfig layers the config file and then the environment under
+// the command-line flags; it's called once, straight after flag.Parse.
+func applyStartupConfig() error {
+	if opts.configFile != "" {
+		values, _, err := loadConfigFile(opts.configFile)
+		if err != nil {
+			return err
+		}
+		if err := applyConfigValues(flag.CommandLine, values, commandLineFlags, "config-file"); err != nil {
+			return fmt.Errorf("%s: %w", opts.configFile, err)
+		}
+	}
+	if err := applyConfigValues(flag.CommandLine, envConfigValues(flag.CommandLine), commandLineFlags, "environment"); err != nil {
+		return fmt.Errorf("environment: %w", err)
+	}
+	return nil
+}
+
+// loadConfigFile returns the flattened flag-name to values mapping; only an
+// array gives more than one value.  The namespace tables are returned
+// separately, each flattened the same way.
+func loadConfigFile(filename string) (values map[string][]string, namespaces map[string]map[string][]string, err error) {
+	raw, err := decodeConfigFile(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	namespaces = make(map[string]map[string][]string)
+	if nsRaw, ok := raw[namespaceTable]; ok {
+		delete(raw, namespaceTable)
+		tables, ok := nsRaw.(map[string]any)
+		if !ok {
+			return nil, nil, fmt.Errorf("%s: %q must be a table of tables", filename, namespaceTable)
+		}
+		for name, v := range tables {
+			table, ok := v.(map[string]any)
+			if !ok {
+				return nil, nil, fmt.Errorf("%s: namespace %q must be a table", filename, name)
+			}
+			namespaces[name] = make(map[string][]string)
+			if err := flattenConfig("", table, namespaces[name]); err != nil {
+				return nil, nil, fmt.Errorf("%s: namespace %q: %w", filename, name, err)
+			}
+		}
+	}
+	values = make(map[string][]string)
+	if err := flattenConfig("", raw, values); err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return values, namespaces, nil
+}
+
+// decodeConfigFile picks the format from the file extension; both decode to
+// the same shape of nested maps.
+func decodeConfigFile(filename string) (map[string]any, error) {
+	var raw map[string]any
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		contents, err := os.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.Unmarshal(contents, &raw); err != nil {
+			return nil, fmt.Errorf("%s: %w", filename, err)
+		}
+		if raw == nil {
+			// an empty YAML document is an empty config
+			raw = make(map[string]any)
+		}
+	default:
+		if _, err := toml.DecodeFile(filename, &raw); err != nil {
+			return nil, err
+		}
+	}
+	return raw, nil
+}
+
+func flattenConfig(prefix string, in map[string]any, out map[string][]string) error {
+	for k, v := range in {
+		name := k
+		if prefix != "" {
+			name = prefix + "." + k
+		}
+		switch tv := v.(type) {
+		case map[string]any:
+			if err := flattenConfig(name, tv, out); err != nil {
+				return err
+			}
+		case []any:
+			items := make([]string, len(tv))
+			for i := range tv {
+				s, err := configScalar(name, tv[i])
+				if err != nil {
+					return err
+				}
+				items[i] = s
+			}
+			out[name] = items
+		default:
+			s, err := configScalar(name, v)
+			if err != nil {
+				return err
+			}
+			out[name] = []string{s}
+		}
+	}
+	return nil
+}
+
+func configScalar(name string, v any) (string, error) {
+	switch tv := v.(type) {
+	case string:
+		return tv, nil
+	case int64:
+		return strconv.FormatInt(tv, 10), nil
+	case int: // YAML
+		return strconv.Itoa(tv), nil
+	case float64:
+		return strconv.FormatFloat(tv, 'g', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(tv), nil
+	}
+	return "", fmt.Errorf("key %q: unsupported value type %T", name, v)
+}
+
+// applyConfigValues sets each value on the flagset, except for those flags
+// in skip.  Unknown keys are an error: a typo should not silently leave a
+// setting at its default.  Keys for flags which exist but which aren't in fs
+// are ignored, which is how a reload only picks up the reloadable settings.
+func applyConfigValues(fs *flag.FlagSet, values map[string][]string, skip map[string]bool, source string) error {
+	names := make([]string, 0, len(values))
+	for k := range values {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if notConfigurable[name] || flag.Lookup(name) == nil {
+			return fmt.Errorf("unknown config key %q", name)
+		}
+		if skip[name] || fs.Lookup(name) == nil {
+			continue
+		}
+		var err error
+		if lv, ok := fs.Lookup(name).Value.(listValue); ok {
+			err = lv.SetList(values[name])
+		} else {
+			err = fs.Set(name, strings.Join(values[name], ","))
+		}
+		if err != nil {
+			return fmt.Errorf("config key %q: %w", name, err)
+		}
+		if fs == flag.CommandLine {
+			configSources[name] = source
+		}
+	}
+	return nil
+}
+
+// printConfig writes every configurable flag's current value as TOML which
+// can be used as a config file, noting where non-default values came from.
+func printConfig(w io.Writer) {
+	fmt.Fprintf(w, "# effective %s configuration\n", fingerProgram)
+	flag.VisitAll(func(f *flag.Flag) {
+		if notConfigurable[f.Name] {
+			return
+		}
+		comment := ""
+		if src, ok := configSources[f.Name]; ok {
+			comment = "  # " + src
+		}
+		fmt.Fprintf(w, "%s = %s%s\n", f.Name, tomlValue(f.Value), comment)
+	})
+}
+
+func tomlValue(v flag.Value) string {
+	if lv, ok := v.(listValue); ok {
+		list := lv.List()
+		items := make([]string, len(list))
+		for i := range list {
+			items[i] = strconv.Quote(list[i])
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	}
+	if g, ok := v.(flag.Getter); ok {
+		switch tv := g.Get().(type) {
+		case bool, int, int64, uint, uint64:
+			return fmt.Sprint(tv)
+		case float64:
+			return strconv.FormatFloat(tv, 'f', -1, 64)
+		}
+	}
+	return strconv.Quote(v.String())
+}
+
+// buildSettings assembles the reloadable settings afresh, with the same
+// precedence as at startup.
+func buildSettings() (*settings, error) {
+	fresh := &settings{}
+	fs := flag.NewFlagSet("settings", flag.ContinueOnError)
+	registerSettingsFlags(fs, fresh)
+
+	var namespaces map[string]map[string][]string
+	if opts.configFile != "" {
+		var values map[string][]string
+		var err error
+		values, namespaces, err = loadConfigFile(opts.configFile)
+		if err != nil {
+			return nil, err
+		}
+		if err := applyConfigValues(fs, values, commandLineFlags, ""); err != nil {
+			return nil, fmt.Errorf("%s: %w", opts.configFile, err)
+		}
+	}
+	if err := applyConfigValues(fs, envConfigValues(fs), commandLineFlags, ""); err != nil {
+		return nil, fmt.Errorf("environment: %w", err)
+	}
+
+	// List flags are copied across whole: their String is for display, and
+	// a repeatable flag's Set adds just one item.
+	var err error
+	flag.Visit(func(f *flag.Flag) {
+		if err != nil || !commandLineFlags[f.Name] || fs.Lookup(f.Name) == nil {
+			return
+		}
+		from, fromList := f.Value.(listValue)
+		to, toList := fs.Lookup(f.Name).Value.(listValue)
+		if fromList && toList {
+			err = to.SetList(from.List())
+		} else {
+			err = fs.Set(f.Name, f.Value.String())
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := fresh.validate(); err != nil {
+		return nil, err
+	}
+	if err := buildNamespaces(fresh, namespaces); err != nil {
+		return nil, fmt.Errorf("%s: %w", opts.configFile, err)
+	}
+	return fresh, nil
+}
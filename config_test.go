@@ -0,0 +1,104 @@
+// Copyright © 2020 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadConfigFileFormats(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"fingerd.toml": `
+alias-file = "/etc/fingerd/aliases"
+"log.level" = "debug"
+proxy-protocol.trusted = ["10.0.0.0/24", "2001:db8:1::/64"]
+
+[passwd]
+min-uid = 1000
+
+[request.timeout]
+read = "5s"
+
+[namespace.example]
+addresses = ["192.0.2.10"]
+homes-dir = ""
+`,
+		"fingerd.yaml": `
+alias-file: /etc/fingerd/aliases
+log.level: debug
+proxy-protocol.trusted: ["10.0.0.0/24", "2001:db8:1::/64"]
+passwd:
+  min-uid: 1000
+request:
+  timeout:
+    read: 5s
+namespace:
+  example:
+    addresses: [192.0.2.10]
+    homes-dir: ""
+`,
+	}
+	files["fingerd.yml"] = files["fingerd.yaml"]
+
+	wantValues := map[string][]string{
+		"alias-file":             {"/etc/fingerd/aliases"},
+		"log.level":              {"debug"},
+		"proxy-protocol.trusted": {"10.0.0.0/24", "2001:db8:1::/64"},
+		"passwd.min-uid":         {"1000"},
+		"request.timeout.read":   {"5s"},
+	}
+	wantNamespaces := map[string]map[string][]string{
+		"example": {"addresses": {"192.0.2.10"}, "homes-dir": {""}},
+	}
+
+	for name, contents := range files {
+		t.Run(name, func(t *testing.T) {
+			filename := filepath.Join(dir, name)
+			if err := os.WriteFile(filename, []byte(contents), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			values, namespaces, err := loadConfigFile(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(values, wantValues) {
+				t.Errorf("values = %v, want %v", values, wantValues)
+			}
+			if !reflect.DeepEqual(namespaces, wantNamespaces) {
+				t.Errorf("namespaces = %v, want %v", namespaces, wantNamespaces)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFileBad(t *testing.T) {
+	dir := t.TempDir()
+	for name, contents := range map[string]string{
+		"syntax.toml":    "alias-file = \n",
+		"syntax.yaml":    "alias-file: [\n",
+		"null.yaml":      "alias-file:\n",
+		"namespace.yaml": "namespace: [a, b]\n",
+	} {
+		filename := filepath.Join(dir, name)
+		if err := os.WriteFile(filename, []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := loadConfigFile(filename); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+
+	empty := filepath.Join(dir, "empty.yaml")
+	if err := os.WriteFile(empty, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if values, _, err := loadConfigFile(empty); err != nil || len(values) != 0 {
+		t.Errorf("empty YAML: values %v err %v", values, err)
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright © 2020 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package main
+
+import (
+	"flag"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// The global limit is applied at accept time.  So is the per-IP limit, against
+// the socket peer, unless that's a trusted proxy: then it waits until the
+// PROXY header has named the client, so is per client not per balancer.
+var limitOpts struct {
+	maxConnections      int
+	maxConnectionsPerIP int
+	rejectMessage       string
+}
+
+func init() {
+	flag.IntVar(&limitOpts.maxConnections, "limit.connections", 0, "max connections in flight across all listeners (0 for no limit)")
+	flag.IntVar(&limitOpts.maxConnectionsPerIP, "limit.connections-per-ip", 0, "max connections in flight from one client IP (0 for no limit)")
+	flag.StringVar(&limitOpts.rejectMessage, "limit.reject-message", "", "line to send to over-limit clients (empty to just close)")
+}
+
+// How long we'll wait to write the reject message; this is in the accept
+// loop, so must be short, but it's a fresh socket so should never block.
+const rejectWriteTimeout = 100 * time.Millisecond
+
+type connectionLimiter struct {
+	sync.Mutex
+	total    int
+	perIP    map[netip.Addr]int
+	rejected uint64
+}
+
+var connLimits = connectionLimiter{perIP: make(map[netip.Addr]int)}
+
+// acquire returns true if the connection may proceed, in which case the
+// caller must later release with the same peer.  A nil peer takes only a
+// global slot; acquirePerIP can add the per-IP one later.  On false, the
+// reason is suitable for logging.
+func (cl *connectionLimiter) acquire(peer net.Addr) (bool, string) {
+	cl.Lock()
+	defer cl.Unlock()
+	if limitOpts.maxConnections > 0 && cl.total >= limitOpts.maxConnections {
+		cl.rejected++
+		return false, "global connection limit"
+	}
+	if !cl.takeIP(peer) {
+		return false, "per-IP connection limit"
+	}
+	cl.total++
+	return true, ""
+}
+
+// acquirePerIP is for a connection which holds a global slot taken with a nil
+// peer; on true, the caller must later release with this peer instead.
+func (cl *connectionLimiter) acquirePerIP(peer net.Addr) (bool, string) {
+	cl.Lock()
+	defer cl.Unlock()
+	if !cl.takeIP(peer) {
+		return false, "per-IP connection limit"
+	}
+	return true, ""
+}
+
+// takeIP must be called with the lock held.
+func (cl *connectionLimiter) takeIP(peer net.Addr) bool {
+	ip, haveIP := addrToNetip(peer)
+	if !haveIP {
+		return true
+	}
+	if limitOpts.maxConnectionsPerIP > 0 && cl.perIP[ip] >= limitOpts.maxConnectionsPerIP {
+		cl.rejected++
+		return false
+	}
+	cl.perIP[ip]++
+	return true
+}
+
+func (cl *connectionLimiter) release(peer net.Addr) {
+	ip, haveIP := addrToNetip(peer)
+	cl.Lock()
+	defer cl.Unlock()
+	cl.total--
+	if haveIP {
+		if cl.perIP[ip] <= 1 {
+			delete(cl.perIP, ip)
+		} else {
+			cl.perIP[ip]--
+		}
+	}
+}
+
+func (cl *connectionLimiter) rejectedCount() uint64 {
+	cl.Lock()
+	defer cl.Unlock()
+	return cl.rejected
+}
+
+// rejectConnection is called from the accept loop, so does not block for long.
+// We don't send anything on a TLS listener: it would be garbage to the client
+// and a handshake is exactly the resource usage we're refusing.
+func (fl *FingerListener) rejectConnection(conn net.Conn, reason string) {
+	log := fl.WithFields(logrus.Fields{
+		"local":          conn.LocalAddr(),
+		"remote":         conn.RemoteAddr(),
+		"reason":         reason,
+		"rejected-total": connLimits.rejectedCount(),
+	})
+	if err := sendRejectMessage(conn, fl.tlsConfig != nil); err != nil {
+		log = log.WithField("write-error", err.Error())
+	}
+	if err := conn.Close(); err != nil {
+		log = log.WithField("close-error", err.Error())
+	}
+	log.Info("over connection limit, rejected")
+}
+
+// rejectOverLimit is for a client found to be over the per-IP limit once a
+// PROXY header has named it; the caller closes the connection.
+func (c *FingerConnection) rejectOverLimit(reason string) {
+	log := c.WithFields(logrus.Fields{
+		"reason":         reason,
+		"rejected-total": connLimits.rejectedCount(),
+	})
+	if err := sendRejectMessage(c.conn, c.l.tlsConfig != nil); err != nil {
+		log = log.WithField("write-error", err.Error())
+	}
+	log.Info("over connection limit, rejected")
+}
+
+func sendRejectMessage(conn net.Conn, isTLS bool) error {
+	if limitOpts.rejectMessage == "" || isTLS {
+		return nil
+	}
+	conn.SetWriteDeadline(time.Now().Add(rejectWriteTimeout))
+	_, err := conn.Write([]byte(limitOpts.rejectMessage + "\r\n"))
+	return err
+}
@@ -0,0 +1,119 @@
+// Copyright © 2020 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package main
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// testListener serves plain finger on loopback until the test ends.
+func testListener(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	shuttingDown := make(chan struct{})
+	fl := &FingerListener{
+		networkFamily: "tcp",
+		mode:          listenModePlain,
+		listener:      ln.(*net.TCPListener),
+		active:        &wg,
+		shuttingDown:  shuttingDown,
+	}
+	logger := logrus.New()
+	logger.Out = io.Discard
+	fl.setupAfterListen(logger)
+	fl.GoServeThenClose()
+	t.Cleanup(func() {
+		close(shuttingDown)
+		wg.Wait()
+	})
+	return ln.Addr().String()
+}
+
+func perIPCount(ip string) int {
+	connLimits.Lock()
+	defer connLimits.Unlock()
+	return connLimits.perIP[netip.MustParseAddr(ip)]
+}
+
+// Behind a trusted proxy, the per-IP limit is per client named in the PROXY
+// header, not for the proxy as a whole.
+func TestConnectionLimitPerProxiedClient(t *testing.T) {
+	savedLimits, savedProxy := limitOpts, proxyOpts
+	defer func() { limitOpts, proxyOpts = savedLimits, savedProxy }()
+	limitOpts.maxConnections = 0
+	limitOpts.maxConnectionsPerIP = 1
+	limitOpts.rejectMessage = "Too busy."
+	if err := proxyOpts.trusted.Set("127.0.0.0/8"); err != nil {
+		t.Fatal(err)
+	}
+	address := testListener(t)
+
+	dial := func(client string) net.Conn {
+		t.Helper()
+		conn, err := net.Dial("tcp", address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write([]byte("PROXY TCP4 " + client + " 127.0.0.1 5000 79\r\n")); err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	exchange := func(client string) string {
+		t.Helper()
+		conn := dial(client)
+		defer conn.Close()
+		_, _ = conn.Write([]byte("\r\n"))
+		reply, _ := io.ReadAll(conn)
+		return string(reply)
+	}
+
+	// one client holds its connection open, once named
+	held := dial("192.0.2.1")
+	for deadline := time.Now().Add(5 * time.Second); perIPCount("192.0.2.1") != 1; {
+		if time.Now().After(deadline) {
+			t.Fatal("held connection never took its per-IP slot")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if perIPCount("127.0.0.1") != 0 {
+		t.Fatal("per-IP slot taken for the proxy")
+	}
+
+	// so others through the same proxy are still served, but not that client
+	if got := exchange("192.0.2.2"); got != "Local user listing denied.\n" {
+		t.Errorf("other client got %q", got)
+	}
+	if got := exchange("192.0.2.1"); got != "Too busy.\r\n" {
+		t.Errorf("over-limit client got %q", got)
+	}
+
+	// and everything is given back, against the keys it was taken with
+	held.Close()
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		connLimits.Lock()
+		total, perIP := connLimits.total, len(connLimits.perIP)
+		connLimits.Unlock()
+		if total == 0 && perIP == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("left holding %d connections, %d IPs", total, perIP)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright © 2020 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package main
+
+import (
+	"flag"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var drainOpts struct {
+	period time.Duration
+}
+
+func init() {
+	flag.DurationVar(&drainOpts.period, "shutdown.drain", 30*time.Second, "on shutdown, how long to let in-flight connections finish before closing them (0 to wait forever)")
+}
+
+// connectionTracker knows the raw socket of each connection in flight, so
+// that we can cut them off.  We close the socket, not whatever the handler has
+// wrapped it in, as the handler goroutine owns c.conn; closing the socket
+// makes any blocked read or write in the handler return promptly.
+type connectionTracker struct {
+	sync.Mutex
+	conns map[*FingerConnection]net.Conn
+}
+
+var inFlight = connectionTracker{conns: make(map[*FingerConnection]net.Conn)}
+
+func (ct *connectionTracker) add(c *FingerConnection, raw net.Conn) {
+	ct.Lock()
+	ct.conns[c] = raw
+	ct.Unlock()
+}
+
+func (ct *connectionTracker) remove(c *FingerConnection) {
+	ct.Lock()
+	delete(ct.conns, c)
+	ct.Unlock()
+}
+
+func (ct *connectionTracker) count() int {
+	ct.Lock()
+	defer ct.Unlock()
+	return len(ct.conns)
+}
+
+// closeAll returns how many connections were cut off.
+func (ct *connectionTracker) closeAll() int {
+	ct.Lock()
+	defer ct.Unlock()
+	for c, raw := range ct.conns {
+		c.cutOff.Store(true)
+		_ = raw.Close()
+	}
+	return len(ct.conns)
+}
+
+// drainConnections is called after the listeners have been told to shut down,
+// and returns once every go-routine on the waitgroup is done.
+func drainConnections(running *sync.WaitGroup, log logrus.FieldLogger) {
+	done := make(chan struct{})
+	go func() {
+		running.Wait()
+		close(done)
+	}()
+
+	log = log.WithField("drain-period", drainOpts.period)
+	log.WithField("active-connections", inFlight.count()).Info("draining connections")
+
+	var expired <-chan time.Time
+	if drainOpts.period > 0 {
+		t := time.NewTimer(drainOpts.period)
+		defer t.Stop()
+		expired = t.C
+	}
+
+	select {
+	case <-done:
+		log.Info("all connections finished")
+	case <-expired:
+		cut := inFlight.closeAll()
+		log.WithField("cut-off", cut).Warn("drain period expired, closed remaining connections")
+		<-done
+	}
+}
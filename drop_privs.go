@@ -18,6 +18,8 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// envKeyFdPassing holds one line per listener, "family:fd:mode"; older
+// releases only passed "family:fd", which we still accept as plain.
 const envKeyFdPassing = "FINGERD_fdstatus"
 
 // if we're running as root, we need to drop privileges and re-exec.
@@ -37,7 +39,7 @@ const envKeyFdPassing = "FINGERD_fdstatus"
 // the socket.  I am disinclined to chase for a way to make that possible, when
 // it's better to just listen on a non-standard port or use
 // CAP_NET_BIND_SERVICE instead.
-func dropPrivileges(tfls []*TCPFingerListener, bareLogger *logrus.Logger) {
+func dropPrivileges(tfls []*FingerListener, bareLogger *logrus.Logger) {
 	if opts.runAsUser == "" {
 		bareLogger.Error("root drop privs: missing --run-as-user to drop privileges to")
 		return
@@ -92,14 +94,14 @@ func dropPrivileges(tfls []*TCPFingerListener, bareLogger *logrus.Logger) {
 	listeningFds := ""
 	for i := range tfls {
 		// This actually does a dup() and probably has FD_CLOEXEC cleared, but we lack a Golang guarantee that it's cleared.
-		fd, err := tfls[i].tcpListener.File()
+		fd, err := tfls[i].listener.File()
 		if err != nil {
 			log.WithError(err).Errorf("unable to get fd from listener (%s)", tfls[i].networkFamily)
 			runtime.UnlockOSThread()
 			return
 		}
 
-		listeningFds += tfls[i].networkFamily + ":" + strconv.Itoa(int(fd.Fd())) + "\n"
+		listeningFds += tfls[i].networkFamily + ":" + strconv.Itoa(int(fd.Fd())) + ":" + tfls[i].mode + "\n"
 
 		// technically we want to mask out the FD_CLOEXEC value, but there are no examples of safely using F_GETFD in the Golang
 		// source tree, they only ever just set to 0 for fork/exec handling of FD_CLOEXEC there, and we're so deep in the weeds
@@ -144,7 +146,7 @@ func inheritedListeners(
 	shuttingDown <-chan struct{},
 	logger *logrus.Logger,
 ) (
-	[]*TCPFingerListener,
+	[]*FingerListener,
 	bool,
 ) {
 
@@ -156,7 +158,7 @@ func inheritedListeners(
 
 	recoveryLogger := logrus.NewEntry(logger).WithField("env-var", envKeyFdPassing)
 
-	tfls := make([]*TCPFingerListener, 0, 3)
+	tfls := make([]*FingerListener, 0, 3)
 
 	i := 0
 	for line := range strings.SplitSeq(details, "\n") {
@@ -164,8 +166,18 @@ func inheritedListeners(
 			continue
 		}
 		fields := strings.Split(line, ":")
-		if len(fields) != 2 {
-			recoveryLogger.Fatal("malformed variable, line not two colon fields")
+		mode := listenModePlain
+		switch len(fields) {
+		case 2:
+		case 3:
+			mode = fields[2]
+		default:
+			recoveryLogger.Fatal("malformed variable, line not two or three colon fields")
+		}
+		switch mode {
+		case listenModePlain, listenModeTLS:
+		default:
+			recoveryLogger.Fatalf("unknown listener mode %q", mode)
 		}
 
 		i++
@@ -180,22 +192,23 @@ func inheritedListeners(
 		if err != nil {
 			recoveryLogger.WithError(err).Fatalf("unable to make a net listener from fd entry %d", i)
 		}
-		tl, ok := listener.(*net.TCPListener)
+		dl, ok := listener.(DeadlineableListener)
 		if !ok {
-			recoveryLogger.Fatalf("net listener from fd entry %d not a *net.TCPListener", i)
+			recoveryLogger.Fatalf("net listener from fd entry %d not a usable listener but instead %T", i, listener)
+		}
+		if ul, ok := dl.(*net.UnixListener); ok {
+			// We created the socket before re-exec, so it's ours to clean up
+			ul.SetUnlinkOnClose(true)
 		}
 
-		fl := &TCPFingerListener{
+		fl := &FingerListener{
 			networkFamily: fields[0],
+			mode:          mode,
 			active:        wg,
 			shuttingDown:  shuttingDown,
-			tcpListener:   tl,
+			listener:      dl,
 		}
-		fl.Entry = logger.WithFields(logrus.Fields{
-			"family": fl.networkFamily,
-			"accept": fl.tcpListener.Addr(),
-			"pid":    os.Getpid(),
-		})
+		fl.setupAfterListen(logger)
 		tfls = append(tfls, fl)
 	}
 
@@ -0,0 +1,74 @@
+// Copyright © 2020 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// escapeText makes control characters and invalid UTF-8 visible, so that
+// text from elsewhere can't drive a terminal.  Tab is left alone, unless raw,
+// which also escapes backslash so that the output is unambiguous: that's for
+// seeing exactly which bytes were sent, line terminators included.
+func escapeText(s string, raw bool) string {
+	if !needsEscape(s, raw) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case r == utf8.RuneError && size == 1:
+			fmt.Fprintf(&b, `\x%02x`, s[i])
+		case r == '\\' && raw:
+			b.WriteString(`\\`)
+		case r == '\t' && !raw:
+			b.WriteRune(r)
+		case r == '\t', r < 0x20, r == 0x7f, r >= 0x80 && r < 0xa0:
+			b.WriteString(escapeRune(r))
+		default:
+			b.WriteString(s[i : i+size])
+		}
+		i += size
+	}
+	return b.String()
+}
+
+// escapeRune gives the visible form of one character, in Go syntax.
+func escapeRune(r rune) string {
+	switch {
+	case r == '\t':
+		return `\t`
+	case r == '\r':
+		return `\r`
+	case r == '\n':
+		return `\n`
+	case r < 0x80:
+		return fmt.Sprintf(`\x%02x`, r)
+	case r < 0x10000:
+		return fmt.Sprintf(`\u%04x`, r)
+	}
+	return fmt.Sprintf(`\U%08x`, r)
+}
+
+func needsEscape(s string, raw bool) bool {
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case r == utf8.RuneError && size == 1:
+			return true
+		case r == '\t' || r == '\\':
+			if raw {
+				return true
+			}
+		case r < 0x20 || r == 0x7f || (r >= 0x80 && r < 0xa0):
+			return true
+		}
+		i += size
+	}
+	return false
+}
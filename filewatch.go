@@ -0,0 +1,171 @@
+// Copyright © 2016,2020 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/fsnotify.v1"
+)
+
+// liveWatchers are closed by a single exit handler, registered on first use;
+// a watcher leaves the set when stopped, so isn't kept for the process life.
+var liveWatchers = struct {
+	sync.Mutex
+	watchers map[*fsnotify.Watcher]struct{}
+	register sync.Once
+}{watchers: make(map[*fsnotify.Watcher]struct{})}
+
+func trackWatcher(w *fsnotify.Watcher) {
+	liveWatchers.register.Do(func() { logrus.RegisterExitHandler(closeLiveWatchers) })
+	liveWatchers.Lock()
+	liveWatchers.watchers[w] = struct{}{}
+	liveWatchers.Unlock()
+}
+
+// closeWatcher is safe to call more than once.
+func closeWatcher(w *fsnotify.Watcher) {
+	liveWatchers.Lock()
+	delete(liveWatchers.watchers, w)
+	liveWatchers.Unlock()
+	_ = w.Close()
+}
+
+func closeLiveWatchers() {
+	liveWatchers.Lock()
+	defer liveWatchers.Unlock()
+	for w := range liveWatchers.watchers {
+		_ = w.Close()
+	}
+	clear(liveWatchers.watchers)
+}
+
+// watchFileForChanges invokes reload whenever filename is modified, created
+// or chmod'd.  We watch the directory too, so as long as the _directory_
+// exists, we'll detect a late file creation and handle it fine.
+//
+// Failure to watch is logged but is not fatal: the caller has already loaded
+// whatever was there at startup and we degrade to not auto-reloading.
+//
+// The returned func stops watching, for when the config points elsewhere.
+func watchFileForChanges(filename string, log logrus.FieldLogger, reload func(logrus.FieldLogger)) (stop func()) {
+	log = log.WithField("subsystem", "fs-watcher")
+	// originally mostly ripped straight from fsnotify.v1's NewWatcher example in the docs
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.WithError(err).Error("unable to start FS watcher, will not detect changes")
+		// We continue on without aborting
+		return func() {}
+	}
+	trackWatcher(watcher)
+
+	var stopped atomic.Bool
+	stop = func() {
+		stopped.Store(true)
+		closeWatcher(watcher)
+	}
+
+	basename := filepath.Base(filename)
+	dirname := filepath.Dir(filename)
+
+	healthSetWatcher(filename, true)
+	go func() {
+		defer func() {
+			if !stopped.Load() {
+				healthSetWatcher(filename, false)
+			}
+		}()
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					if stopped.Load() {
+						log.Info("stopped watching")
+					} else {
+						log.Warn("terminating config-watcher event dispatcher")
+					}
+					return
+				}
+				l := log.WithField("event", event)
+				switch filepath.Base(event.Name) {
+				case basename:
+					if event.Op&fsnotify.Write == fsnotify.Write {
+						l.Info("modification detected")
+						// The actual work!  (also in some other edge-cases just below)
+						reload(log)
+					} else if event.Op&fsnotify.Create == fsnotify.Create {
+						// better late than never
+						l.Info("creation detected (adding watch)")
+						reload(log)
+						watcher.Add(filename)
+					} else if event.Op&fsnotify.Chmod == fsnotify.Chmod {
+						// assume file created with 0 permissions then chmod'd more open, so our initial read might
+						// have failed.  Should be harmless to re-read the file.  If it was chmod'd unreadable, we'll
+						// error out cleanly.
+						l.Info("chmod detected")
+						reload(log)
+					} else if event.Op&fsnotify.Remove == fsnotify.Remove || event.Op&fsnotify.Rename == fsnotify.Rename {
+						// I have seen this fire when the watched config file
+						// is an entry in a K8S configmap and the entry was
+						// modified, not deleted.
+						_, err := os.Stat(event.Name)
+						if err != nil && os.IsNotExist(err) {
+							l.Info("file gone, confirmed, WATCH GONE")
+						} else {
+							l.Info("file gone, false positive, file still exists, re-watching")
+							// The kernel will have removed the watch and
+							// fsnotify will have removed its copy, to match.
+							// We can't just ignore this, we have to add the
+							// watch back.
+							watcher.Add(filename)
+						}
+						// TODO: should we also remove the loaded data?
+						// We currently continue running with the last data seen, which lets us
+						// steady-state on the assumption that the file is being replaced.  Perhaps
+						// we should start a timer and after 5 seconds, nuke the loaded data?
+					}
+					// no other scenarios known
+				case dirname:
+					// usually ...
+					// nothing to do; file creation will create an event named for the file, which we detect above for the file
+					// which we care about; chmod ... we care less about.
+					if event.Op&fsnotify.Remove == fsnotify.Remove || event.Op&fsnotify.Rename == fsnotify.Rename {
+						l.Warn("directory of config file gone, nuking watcher, no notifications anymore")
+						closeWatcher(watcher)
+						return
+					}
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					log.Warn("terminating config-watcher event dispatcher")
+					return
+				}
+				log.WithError(err).Warn("error")
+			}
+		}
+	}()
+
+	count := 0
+	for _, p := range []string{filename, dirname} {
+		err = watcher.Add(p)
+		if err != nil {
+			log.WithError(err).WithField("file", p).Info("unable to start watching")
+			// do not error out
+		} else {
+			count++
+		}
+	}
+
+	if count == 0 {
+		log.Warn("unable to set up any watches, terminating FS watcher, auto-reloading gone")
+		closeWatcher(watcher)
+		healthSetWatcher(filename, false)
+	}
+	return stop
+}
@@ -0,0 +1,54 @@
+// Copyright © 2020 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func liveWatcherCount() int {
+	liveWatchers.Lock()
+	defer liveWatchers.Unlock()
+	return len(liveWatchers.watchers)
+}
+
+// Stopped watchers are forgotten, and the exit handler closes the rest.
+func TestLiveWatchers(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = io.Discard
+	dir := t.TempDir()
+	before := liveWatcherCount()
+
+	var stops []func()
+	for _, name := range []string{"one", "two", "three"} {
+		filename := filepath.Join(dir, name)
+		if err := os.WriteFile(filename, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		stops = append(stops, watchFileForChanges(filename, logger, func(logrus.FieldLogger) {}))
+	}
+	if n := liveWatcherCount() - before; n != 3 {
+		t.Fatalf("%d watchers live, want 3", n)
+	}
+
+	stops[0]()
+	stops[0]()
+	if n := liveWatcherCount() - before; n != 2 {
+		t.Fatalf("%d watchers live after a stop, want 2", n)
+	}
+
+	closeLiveWatchers()
+	if n := liveWatcherCount(); n != 0 {
+		t.Fatalf("%d watchers live after exit handler", n)
+	}
+	for _, stop := range stops[1:] {
+		stop() // still safe
+	}
+}
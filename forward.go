@@ -0,0 +1,339 @@
+// Copyright © 2020 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Forwarding of `user@host` queries (RFC 1288 section 2.5.5), only to hosts
+// on -forward.allow; with no allow-list, there's no forwarding and such
+// queries are just unknown users, as before.  We speak finger ourselves,
+// rather than running finger(1).  A chain `user@a@b` goes to b, asking for
+// `user@a`, so each hop strips one host; a chain naming a host twice, or
+// naming this server by one of -forward.self-names, or longer than
+// -forward.max-hops, is refused as a loop.
+//
+// Each forward costs the client a lookup, as any name does, and also comes
+// out of a separate -forward.ratelimit allowance which applies even with no
+// -ratelimit.lookups, since it's someone else's server we'd be loading.  Only
+// -forward.max-per-request names in one request are forwarded.
+//
+// The reply is read in full, up to -forward.size-limit, before any of it is
+// sent on, and each line is sanitized as for served files; since it's not
+// our content, "raw" is treated as "utf8".  The host we asked comes first,
+// as `[host]`, as finger(1) does.
+
+const forwardDeniedText = "Finger forwarding service denied."
+
+type forwardTarget struct {
+	name    string // as it appears in requests, lower-cased
+	address string // host:port to connect to
+}
+
+// forwardAllowList is a flag.Value holding comma-separated HOST[:PORT].
+type forwardAllowList []forwardTarget
+
+func (fl *forwardAllowList) String() string {
+	if fl == nil {
+		return ""
+	}
+	return strings.Join(fl.List(), ",")
+}
+
+func (fl *forwardAllowList) Set(value string) error {
+	var out forwardAllowList
+	for item := range strings.SplitSeq(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		host, port, err := net.SplitHostPort(item)
+		if err != nil {
+			host = strings.TrimSuffix(strings.TrimPrefix(item, "["), "]")
+			port = clientDefaultPort
+		}
+		if host == "" || strings.ContainsAny(host, "@/ \t") {
+			return fmt.Errorf("forward.allow %q: not a host", item)
+		}
+		out = append(out, forwardTarget{name: strings.ToLower(host), address: net.JoinHostPort(host, port)})
+	}
+	*fl = out
+	return nil
+}
+
+func (fl *forwardAllowList) SetList(values []string) error {
+	return fl.Set(strings.Join(values, ","))
+}
+
+func (fl *forwardAllowList) List() []string {
+	s := make([]string, len(*fl))
+	for i, t := range *fl {
+		s[i] = t.address
+	}
+	return s
+}
+
+func (fl forwardAllowList) lookup(host string) (forwardTarget, bool) {
+	host = strings.ToLower(host)
+	for _, t := range fl {
+		if t.name == host {
+			return t, true
+		}
+	}
+	return forwardTarget{}, false
+}
+
+// hostNameList is a flag.Value holding comma-separated host names.
+type hostNameList []string
+
+func (hl *hostNameList) String() string {
+	if hl == nil {
+		return ""
+	}
+	return strings.Join(*hl, ",")
+}
+
+func (hl *hostNameList) Set(value string) error {
+	var out hostNameList
+	for item := range strings.SplitSeq(value, ",") {
+		item = strings.ToLower(strings.Trim(strings.TrimSpace(item), "[]"))
+		if item == "" {
+			continue
+		}
+		if strings.ContainsAny(item, "@/: \t") && net.ParseIP(item) == nil {
+			return fmt.Errorf("%q: not a host name", item)
+		}
+		out = append(out, item)
+	}
+	*hl = out
+	return nil
+}
+
+func (hl *hostNameList) SetList(values []string) error {
+	return hl.Set(strings.Join(values, ","))
+}
+
+func (hl *hostNameList) List() []string {
+	return slices.Clone(*hl)
+}
+
+func (hl hostNameList) contains(host string) bool {
+	return slices.Contains(hl, strings.ToLower(strings.Trim(host, "[]")))
+}
+
+var forwardOpts struct {
+	allow          forwardAllowList
+	selfNames      hostNameList
+	connectTimeout time.Duration
+	readTimeout    time.Duration
+	sizeLimit      int64
+	maxHops        int
+	maxPerRequest  int
+	rateLimit      float64
+}
+
+func init() {
+	flag.Var(&forwardOpts.allow, "forward.allow", "comma-separated HOST[:PORT] which user@HOST queries may be forwarded to (empty to not forward)")
+	flag.Var(&forwardOpts.selfNames, "forward.self-names", "comma-separated names for this server, never forwarded to (default the hostname and the hosts listened on)")
+	flag.DurationVar(&forwardOpts.connectTimeout, "forward.timeout.connect", 5*time.Second, "timeout for connecting to a forwarding destination")
+	flag.DurationVar(&forwardOpts.readTimeout, "forward.timeout.read", 10*time.Second, "timeout for the whole exchange with a forwarding destination")
+	flag.Int64Var(&forwardOpts.sizeLimit, "forward.size-limit", 64*1024, "how much of a forwarded reply we will pass on")
+	flag.IntVar(&forwardOpts.maxHops, "forward.max-hops", 3, "most hosts allowed in a user@a@b chain")
+	flag.IntVar(&forwardOpts.maxPerRequest, "forward.max-per-request", 1, "most user@host names forwarded from one request")
+	flag.Float64Var(&forwardOpts.rateLimit, "forward.ratelimit", 10, "forwards allowed per client network per -ratelimit.interval")
+}
+
+var forwardLimits = newLookupRateLimiter(func() (lookups, burst float64) {
+	return forwardOpts.rateLimit, forwardOpts.rateLimit
+})
+
+func forwardingEnabled() bool {
+	return len(forwardOpts.allow) > 0
+}
+
+// We buffer the whole of a forwarded reply, per connection.
+const maxForwardSizeLimit = 1024 * 1024
+
+func checkForwardOpts() error {
+	var errs []error
+	if forwardOpts.sizeLimit <= 0 || forwardOpts.sizeLimit > maxForwardSizeLimit {
+		errs = append(errs, fmt.Errorf("forward.size-limit %d not in range 1..%d", forwardOpts.sizeLimit, maxForwardSizeLimit))
+	}
+	if forwardOpts.maxHops < 1 {
+		errs = append(errs, fmt.Errorf("forward.max-hops %d less than 1", forwardOpts.maxHops))
+	}
+	if forwardOpts.maxPerRequest < 1 {
+		errs = append(errs, fmt.Errorf("forward.max-per-request %d less than 1", forwardOpts.maxPerRequest))
+	}
+	if forwardOpts.rateLimit <= 0 {
+		errs = append(errs, fmt.Errorf("forward.ratelimit %g not positive", forwardOpts.rateLimit))
+	}
+	if forwardOpts.connectTimeout <= 0 || forwardOpts.readTimeout <= 0 {
+		errs = append(errs, errors.New("forward timeouts must be positive"))
+	}
+	return errors.Join(errs...)
+}
+
+// selfNames is -forward.self-names, or if that's unset then our hostname and
+// the hosts we listen on; listening on all addresses adds the loopback ones.
+func selfNames() hostNameList {
+	if len(forwardOpts.selfNames) > 0 {
+		return forwardOpts.selfNames
+	}
+	var names hostNameList
+	add := func(name string) {
+		if name = strings.ToLower(name); !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		add(hostname)
+	}
+	var specs []string
+	if opts.listen != "" || opts.listenEnv != "" {
+		if spec, err := deriveListenPort(opts.listen, opts.listenEnv); err == nil {
+			specs = append(specs, spec)
+		}
+	}
+	if tlsOpts.listen != "" {
+		if spec, err := deriveListenPort(tlsOpts.listen, ""); err == nil {
+			specs = append(specs, spec)
+		}
+	}
+	for _, spec := range specs {
+		host, _, _ := net.SplitHostPort(spec) // derived, so splits
+		if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+			add("localhost")
+			add("127.0.0.1")
+			add("::1")
+			continue
+		}
+		add(host)
+	}
+	return names
+}
+
+// forwardDenial returns why the query should not be forwarded, or "".
+func forwardDenial(query string) (host string, why string) {
+	hops := strings.Split(query, "@")[1:]
+	host = hops[len(hops)-1]
+	if len(hops) > forwardOpts.maxHops {
+		return host, fmt.Sprintf("%d hops, more than forward.max-hops %d", len(hops), forwardOpts.maxHops)
+	}
+	self := selfNames()
+	seen := make(map[string]bool, len(hops))
+	for _, h := range hops {
+		h = strings.ToLower(h)
+		if h == "" {
+			return host, "empty host"
+		}
+		if seen[h] {
+			return host, fmt.Sprintf("loop, %q named twice", h)
+		}
+		if self.contains(h) {
+			return host, fmt.Sprintf("loop, %q names this server", h)
+		}
+		seen[h] = true
+	}
+	if _, ok := forwardOpts.allow.lookup(host); !ok {
+		return host, "host not in forward.allow"
+	}
+	return host, ""
+}
+
+// forwardQuery handles c.username as a user@host query.
+func (c *FingerConnection) forwardQuery() (written int64) {
+	host, why := forwardDenial(c.username)
+	c.forwards++
+	switch {
+	case why != "":
+	case c.forwards > forwardOpts.maxPerRequest:
+		why = fmt.Sprintf("more than forward.max-per-request %d", forwardOpts.maxPerRequest)
+	case !forwardLimits.allow(c.remote):
+		why = "forward rate limit exceeded"
+	}
+	log := c.WithField("forward-host", host)
+	if why != "" {
+		log.WithField("reason", why).Info("forwarding denied")
+		metricRequests.WithLabelValues(outcomeForwardDenied).Inc()
+		return c.sendLine(forwardDeniedText)
+	}
+	target, _ := forwardOpts.allow.lookup(host)
+
+	request := c.username[:strings.LastIndexByte(c.username, '@')]
+	if c.long {
+		request = strings.TrimSpace("/W " + request)
+	}
+
+	reply, truncated, err := forwardExchange(target.address, request)
+	if err != nil {
+		log.WithError(err).Info("forwarding failed")
+		metricRequests.WithLabelValues(outcomeForwardFailed).Inc()
+		return c.sendLine(fmt.Sprintf("finger: %s: forwarding failed", target.name))
+	}
+	log.WithFields(logrus.Fields{"size": len(reply), "truncated": truncated}).Info("forwarded")
+	metricRequests.WithLabelValues(outcomeForwarded).Inc()
+
+	written += c.sendLine("[" + target.name + "]")
+	if c.writeError {
+		return
+	}
+	mode := outputOpts.sanitize
+	if mode == sanitizeRaw {
+		mode = sanitizeUTF8
+	}
+	for line := range bytes.Lines(reply) {
+		line = bytes.TrimSuffix(bytes.TrimSuffix(line, []byte{'\n'}), []byte{'\r'})
+		line, _ = sanitizeLine(line, mode, outputOpts.strip)
+		written += c.sendLine(string(line))
+		if c.writeError {
+			return
+		}
+	}
+	if truncated {
+		written += c.sendLine("[reply truncated]")
+	}
+	return
+}
+
+// forwardExchange sends the request to address and returns the reply, up
+// to -forward.size-limit.
+func forwardExchange(address, request string) (reply []byte, truncated bool, err error) {
+	conn, err := net.DialTimeout("tcp", address, forwardOpts.connectTimeout)
+	if err != nil {
+		return nil, false, err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(forwardOpts.readTimeout))
+
+	if _, err := conn.Write([]byte(request + "\r\n")); err != nil {
+		return nil, false, fmt.Errorf("sending request: %w", err)
+	}
+	reply, err = io.ReadAll(io.LimitReader(conn, forwardOpts.sizeLimit+1))
+	if err != nil {
+		var ne net.Error
+		if !errors.As(err, &ne) || !ne.Timeout() || len(reply) == 0 {
+			return nil, false, fmt.Errorf("reading reply: %w", err)
+		}
+		// A slow server still gets what it managed to send.
+		truncated = true
+	}
+	if int64(len(reply)) > forwardOpts.sizeLimit {
+		reply, truncated = reply[:forwardOpts.sizeLimit], true
+	}
+	return reply, truncated, nil
+}
@@ -0,0 +1,211 @@
+// Copyright © 2020 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package main
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func withForwardOpts(t *testing.T, allow string) {
+	t.Helper()
+	saved := forwardOpts
+	t.Cleanup(func() { forwardOpts = saved })
+	if err := forwardOpts.allow.Set(allow); err != nil {
+		t.Fatal(err)
+	}
+	if err := forwardOpts.selfNames.Set("self.example.org"); err != nil {
+		t.Fatal(err)
+	}
+	forwardOpts.maxHops = 3
+	forwardOpts.connectTimeout = time.Second
+	forwardOpts.readTimeout = time.Second
+	forwardOpts.sizeLimit = 1024
+	forwardOpts.maxPerRequest = 1
+	forwardOpts.rateLimit = 10
+}
+
+func TestForwardDenial(t *testing.T) {
+	withForwardOpts(t, "eng.example.org,ops.example.org:1079,a,b,self.example.org")
+	for _, tc := range []struct {
+		query  string
+		host   string
+		denied bool
+	}{
+		{"alice@eng.example.org", "eng.example.org", false},
+		{"alice@ENG.Example.ORG", "ENG.Example.ORG", false},
+		{"@eng.example.org", "eng.example.org", false},
+		{"alice@ops.example.org", "ops.example.org", false},
+		{"alice@other.example.org", "other.example.org", true},
+		{"alice@", "", true},
+		{"alice@@eng.example.org", "eng.example.org", true},
+		{"alice@eng.example.org@", "", true},
+		{"alice@a@b", "b", false},
+		{"alice@b@a@b", "b", true},
+		{"alice@A@a", "a", true},
+		{"alice@x@a@b", "b", false},
+		{"alice@y@x@a@b", "b", true}, // four hops
+		{"alice@self.example.org", "self.example.org", true},
+		{"alice@Self.Example.Org@eng.example.org", "eng.example.org", true},
+	} {
+		host, why := forwardDenial(tc.query)
+		if host != tc.host || (why != "") != tc.denied {
+			t.Errorf("%q: host %q why %q; want host %q denied=%v", tc.query, host, why, tc.host, tc.denied)
+		}
+	}
+}
+
+func TestForwardSelfNamesDefault(t *testing.T) {
+	withForwardOpts(t, "")
+	savedOpts, savedTLS := opts, tlsOpts
+	defer func() { opts, tlsOpts = savedOpts, savedTLS }()
+	forwardOpts.selfNames = nil
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostname = strings.ToLower(hostname)
+
+	for _, tc := range []struct {
+		listen, tlsListen string
+		want              []string
+	}{
+		{"192.0.2.1:79", "", []string{hostname, "192.0.2.1"}},
+		{"192.0.2.1:79", "[2001:db8::1]:1079", []string{hostname, "192.0.2.1", "2001:db8::1"}},
+		{":79", "", []string{hostname, "localhost", "127.0.0.1", "::1"}},
+		{"", "0.0.0.0:1079", []string{hostname, "localhost", "127.0.0.1", "::1"}},
+		{"", "", []string{hostname}},
+	} {
+		opts.listen, opts.listenEnv, tlsOpts.listen = tc.listen, "", tc.tlsListen
+		if got := []string(selfNames()); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("listen %q tls %q: self-names %q, want %q", tc.listen, tc.tlsListen, got, tc.want)
+		}
+	}
+
+	opts.listen = ":79"
+	if _, why := forwardDenial("alice@" + hostname); why == "" {
+		t.Error("forwarding to our own hostname not refused")
+	}
+}
+
+// stubFingerServer accepts one connection, checks the request and replies
+// with reply, then stalls for stall before closing.
+func stubFingerServer(t *testing.T, wantRequest, reply string, stall time.Duration) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		ln.Close()
+		<-done
+	})
+	go func() {
+		defer close(done)
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		request, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil || request != wantRequest {
+			t.Errorf("stub got request %q, %v; want %q", request, err, wantRequest)
+			return
+		}
+		_, _ = conn.Write([]byte(reply))
+		time.Sleep(stall)
+	}()
+	return ln.Addr().String()
+}
+
+func TestForwardExchange(t *testing.T) {
+	withForwardOpts(t, "")
+	forwardOpts.sizeLimit = 16
+	forwardOpts.readTimeout = 200 * time.Millisecond
+
+	for _, tc := range []struct {
+		name      string
+		reply     string
+		stall     time.Duration
+		want      string
+		truncated bool
+		wantErr   bool
+	}{
+		{name: "whole", reply: "Plan: lunch\r\n", want: "Plan: lunch\r\n"},
+		{name: "exactly the limit", reply: "0123456789abcdef", want: "0123456789abcdef"},
+		{name: "over the limit", reply: "0123456789abcdefXYZ", want: "0123456789abcdef", truncated: true},
+		{name: "timeout with partial data", reply: "Plan: lu", stall: 500 * time.Millisecond, want: "Plan: lu", truncated: true},
+		{name: "timeout with nothing", stall: 500 * time.Millisecond, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			address := stubFingerServer(t, "/W alice\r\n", tc.reply, tc.stall)
+			start := time.Now()
+			reply, truncated, err := forwardExchange(address, "/W alice")
+			if elapsed := time.Since(start); elapsed > 450*time.Millisecond {
+				t.Errorf("took %v, past the read timeout", elapsed)
+			}
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("want error, got %q", reply)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(reply) != tc.want || truncated != tc.truncated {
+				t.Errorf("got %q truncated=%v, want %q truncated=%v", reply, truncated, tc.want, tc.truncated)
+			}
+		})
+	}
+
+	// nothing listening
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := ln.Addr().String()
+	ln.Close()
+	if _, _, err := forwardExchange(address, "alice"); err == nil {
+		t.Error("no error connecting to a closed port")
+	}
+}
+
+func TestForwardLimits(t *testing.T) {
+	address := stubFingerServer(t, "alice\r\n", "Plan: lunch\r\n", 0)
+	withForwardOpts(t, address)
+	host, _, _ := net.SplitHostPort(address)
+	client := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1}
+
+	savedLimits := forwardLimits
+	defer func() { forwardLimits = savedLimits }()
+	forwardLimits = newLookupRateLimiter(forwardLimits.rate)
+	forwardOpts.rateLimit = 1
+
+	// only the first of two is forwarded; the second is refused before it
+	// can take from the rate limit
+	c, conn := testConnection(t, "alice@"+host+" bob@"+host+"\r\n")
+	c.remote = client
+	c.serveRequest()
+	want := "[" + host + "]\r\nPlan: lunch\r\n\r\n" + forwardDeniedText + "\r\n"
+	if got := conn.response.String(); got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	// and then the client's network has had its allowance, even though
+	// -ratelimit.lookups is unset
+	c, conn = testConnection(t, "alice@"+host+"\r\n")
+	c.remote = client
+	c.serveRequest()
+	if got := conn.response.String(); !strings.Contains(got, forwardDeniedText) {
+		t.Fatalf("not rate-limited: %q", got)
+	}
+}
@@ -0,0 +1,225 @@
+// Copyright © 2020 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Lookup by real name, from the first comma-separated field of GECOS, with
+// `&` standing for the capitalized login name (see behavior.md).  Names have
+// spaces and requests don't, so in both the name and the request, any run
+// of spaces, `.` or `_` is treated as one space: `john.smith`, `John_Smith`
+// and `j.smith` (for "J. Smith") all work.  A name shared by more than one
+// user matches nobody.
+//
+// There's no portable way to enumerate users, so we read the passwd file
+// ourselves, which means users only in NSS (LDAP, etc) aren't found by name.
+// The file is re-read when it changes, checked every -passwd.gecos-refresh,
+// rather than per request.
+var gecosOpts struct {
+	enabled bool
+	file    string
+	refresh time.Duration
+}
+
+func init() {
+	flag.BoolVar(&gecosOpts.enabled, "passwd.gecos-lookup", false, "also look users up by real name (needs -passwd.min-uid)")
+	flag.StringVar(&gecosOpts.file, "passwd.file", "/etc/passwd", "passwd file to index real names from")
+	flag.DurationVar(&gecosOpts.refresh, "passwd.gecos-refresh", 5*time.Minute, "how often to check the passwd file for changes")
+}
+
+type passwdEntry struct {
+	login    string
+	uid      uint64
+	realName string
+	homeDir  string
+	gecos    string
+}
+
+// The index is also used for the other GECOS fields, which os/user doesn't
+// give us, for display.
+var passwdIndex struct {
+	sync.RWMutex
+	byName  map[string][]passwdEntry
+	byLogin map[string]passwdEntry
+	mtime   time.Time
+	size    int64
+}
+
+// normalizeRealName gives the form used for matching names to requests.
+func normalizeRealName(name string) string {
+	return strings.Join(strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return r == ' ' || r == '\t' || r == '.' || r == '_'
+	}), " ")
+}
+
+// gecosRealName applies the GECOS conventions to get the real name.
+func gecosRealName(gecos, login string) string {
+	name, _, _ := strings.Cut(gecos, ",")
+	if strings.Contains(name, "&") && login != "" {
+		name = strings.ReplaceAll(name, "&", strings.ToUpper(login[:1])+login[1:])
+	}
+	return strings.TrimSpace(name)
+}
+
+// lookupRealName returns the user with the name, if exactly one user with
+// uid at least minUID has it.
+func lookupRealName(name string, minUID uint64, log logrus.FieldLogger) (passwdEntry, bool) {
+	passwdIndex.RLock()
+	candidates := passwdIndex.byName[normalizeRealName(name)]
+	passwdIndex.RUnlock()
+
+	var match passwdEntry
+	matches := 0
+	for _, e := range candidates {
+		if e.uid < minUID {
+			continue
+		}
+		match = e
+		matches++
+	}
+	switch matches {
+	case 0:
+		return passwdEntry{}, false
+	case 1:
+		return match, true
+	}
+	log.WithField("matches", matches).Info("real name ambiguous, treating as unknown")
+	return passwdEntry{}, false
+}
+
+func init() {
+	registerResolver("realname", resolverFunc(resolveRealName))
+}
+
+// resolveRealName is meant to go last, so that a login name always wins over
+// someone's real name.
+func resolveRealName(q *userQuery) (fingerUser, resolution) {
+	if q.cfg.minPasswdUID == 0 || !gecosOpts.enabled {
+		return fingerUser{}, resolveNext
+	}
+	e, ok := lookupRealName(q.username, q.cfg.minPasswdUID, q.log)
+	if !ok {
+		return fingerUser{}, resolveNext
+	}
+	q.log.WithField("login", e.login).Debug("real name matched")
+	f, ok, _ := passwdUserHome(uint32(e.uid), e.homeDir, q.log)
+	if !ok {
+		return fingerUser{}, resolveDenied
+	}
+	f.realName, f.gecosFields = passwdAccountInfo(e.login, e.uid, e.realName)
+	return f, resolveFound
+}
+
+// passwdIndexEntry is for a login already found some other way.
+func passwdIndexEntry(login string) (passwdEntry, bool) {
+	passwdIndex.RLock()
+	defer passwdIndex.RUnlock()
+	e, ok := passwdIndex.byLogin[login]
+	return e, ok
+}
+
+// passwdAccountInfo gives what we might show about a passwd user; without
+// an index entry, we only have the real name which os/user gave us.
+func passwdAccountInfo(login string, uid uint64, osName string) (realName string, fields map[string]string) {
+	if e, ok := passwdIndexEntry(login); ok && e.uid == uid {
+		return e.realName, splitGECOSFields(e.gecos)
+	}
+	return gecosRealName(osName, login), nil
+}
+
+// passwdIndexWanted is true if anything configured uses the index.
+func passwdIndexWanted() bool {
+	return gecosOpts.enabled || len(showOpts.longFields) > 0
+}
+
+// loadPasswdIndex re-reads the passwd file if it has changed.
+func loadPasswdIndex(log logrus.FieldLogger) {
+	log = log.WithField("file", gecosOpts.file)
+	fi, err := os.Stat(gecosOpts.file)
+	if err != nil {
+		log.WithError(err).Warn("unable to stat passwd file, keeping real-name index")
+		return
+	}
+	passwdIndex.RLock()
+	unchanged := fi.ModTime().Equal(passwdIndex.mtime) && fi.Size() == passwdIndex.size
+	passwdIndex.RUnlock()
+	if unchanged {
+		return
+	}
+
+	fh, err := os.Open(gecosOpts.file)
+	if err != nil {
+		log.WithError(err).Warn("unable to open passwd file, keeping real-name index")
+		return
+	}
+	defer fh.Close()
+
+	byName := make(map[string][]passwdEntry)
+	byLogin := make(map[string]passwdEntry)
+	count := 0
+	s := bufio.NewScanner(fh)
+	for s.Scan() {
+		line := s.Text()
+		if line == "" || line[0] == '#' || line[0] == '+' || line[0] == '-' {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		if _, seen := byLogin[fields[0]]; len(fields) < 6 || fields[0] == "" || seen {
+			continue
+		}
+		uid, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			continue
+		}
+		realName := gecosRealName(fields[4], fields[0])
+		e := passwdEntry{login: fields[0], uid: uid, realName: realName, homeDir: fields[5], gecos: fields[4]}
+		byLogin[e.login] = e
+		key := normalizeRealName(realName)
+		if key == "" {
+			continue
+		}
+		byName[key] = append(byName[key], e)
+		count++
+	}
+	if err := s.Err(); err != nil {
+		log.WithError(err).Warn("problem reading passwd file, keeping real-name index")
+		return
+	}
+
+	passwdIndex.Lock()
+	passwdIndex.byName = byName
+	passwdIndex.byLogin = byLogin
+	passwdIndex.mtime = fi.ModTime()
+	passwdIndex.size = fi.Size()
+	passwdIndex.Unlock()
+	log.WithField("names", count).Info("indexed real names")
+}
+
+// startPasswdIndex loads the index and keeps it fresh; call it after
+// dropping privileges, like the other file loads.
+func startPasswdIndex(log logrus.FieldLogger) {
+	log = log.WithField("subsystem", "gecos")
+	loadPasswdIndex(log)
+	if gecosOpts.refresh <= 0 {
+		return
+	}
+	go func() {
+		t := time.NewTicker(gecosOpts.refresh)
+		defer t.Stop()
+		for range t.C {
+			loadPasswdIndex(log)
+		}
+	}()
+}
@@ -0,0 +1,150 @@
+// Copyright © 2020 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Alias file states, for readiness.  A missing alias file is fine, we'll pick
+// it up if it appears; one we can't read is not.
+const (
+	aliasStateDisabled = "disabled"
+	aliasStatePending  = "pending"
+	aliasStateLoaded   = "loaded"
+	aliasStateAbsent   = "absent"
+	aliasStateError    = "error"
+)
+
+var health struct {
+	sync.Mutex
+	listenersExpected int
+	listenersServing  int
+	// aliasStates is keyed by filename; no alias files means disabled
+	aliasStates map[string]string
+	// watchers is keyed by filename; false once the watcher has given up
+	watchers     map[string]bool
+	shuttingDown bool
+}
+
+func init() {
+	health.aliasStates = make(map[string]string)
+	health.watchers = make(map[string]bool)
+	httpMux.HandleFunc("/healthz", serveHealthz)
+	httpMux.HandleFunc("/readyz", serveReadyz)
+}
+
+func healthSetListenersExpected(n int) {
+	health.Lock()
+	health.listenersExpected = n
+	health.Unlock()
+}
+
+func healthListenerServing(delta int) {
+	health.Lock()
+	health.listenersServing += delta
+	health.Unlock()
+}
+
+func healthSetAliasState(filename, state string) {
+	health.Lock()
+	health.aliasStates[filename] = state
+	health.Unlock()
+}
+
+// healthForgetAliasFile is for an alias file no longer in use.
+func healthForgetAliasFile(filename string) {
+	health.Lock()
+	delete(health.aliasStates, filename)
+	health.Unlock()
+}
+
+func healthSetWatcher(filename string, alive bool) {
+	health.Lock()
+	health.watchers[filename] = alive
+	health.Unlock()
+}
+
+// healthForgetWatcher is for a watcher stopped deliberately, which is not a
+// degradation.
+func healthForgetWatcher(filename string) {
+	health.Lock()
+	delete(health.watchers, filename)
+	health.Unlock()
+}
+
+func healthSetShuttingDown() {
+	health.Lock()
+	health.shuttingDown = true
+	health.Unlock()
+}
+
+// readiness returns whether we're ready, and one line per check.
+func readiness() (bool, []string) {
+	health.Lock()
+	defer health.Unlock()
+
+	ready := true
+	report := make([]string, 0, 3+len(health.aliasStates)+len(health.watchers))
+	check := func(ok bool, format string, args ...any) {
+		status := "ok"
+		if !ok {
+			status = "FAIL"
+			ready = false
+		}
+		report = append(report, status+": "+fmt.Sprintf(format, args...))
+	}
+
+	check(!health.shuttingDown, "shutting-down=%v", health.shuttingDown)
+	check(health.listenersExpected > 0 && health.listenersServing == health.listenersExpected,
+		"listeners serving %d of %d", health.listenersServing, health.listenersExpected)
+	if len(health.aliasStates) == 0 {
+		check(true, "alias-file %s", aliasStateDisabled)
+	}
+	files := make([]string, 0, len(health.aliasStates))
+	for f := range health.aliasStates {
+		files = append(files, f)
+	}
+	sort.Strings(files)
+	for _, f := range files {
+		switch state := health.aliasStates[f]; state {
+		case aliasStateLoaded, aliasStateAbsent:
+			check(true, "alias-file %q %s", f, state)
+		default:
+			check(false, "alias-file %q %s", f, state)
+		}
+	}
+
+	names := make([]string, 0, len(health.watchers))
+	for n := range health.watchers {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		alive := health.watchers[n]
+		check(alive, "fs-watcher %q alive=%v", n, alive)
+	}
+
+	return ready, report
+}
+
+// serveHealthz is liveness: if we can answer at all, we're alive.
+func serveHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "ok")
+}
+
+func serveReadyz(w http.ResponseWriter, r *http.Request) {
+	ready, report := readiness()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	fmt.Fprintln(w, strings.Join(report, "\n"))
+}
@@ -0,0 +1,109 @@
+// Copyright © 2020 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// The healthcheck subcommand is for container HEALTHCHECK and the like: it
+// speaks finger to our own listener, so is invoked with the same -listen or
+// -listen-env flags as the daemon.
+var healthcheckOpts struct {
+	address string
+	user    string
+	expect  string
+	timeout time.Duration
+}
+
+func init() {
+	flag.StringVar(&healthcheckOpts.address, "healthcheck.address", "", "address to probe (default derived from -listen; \"unix:/path\" for a socket)")
+	flag.StringVar(&healthcheckOpts.user, "healthcheck.user", "", "username to probe with (empty asks for a listing, which we deny)")
+	flag.StringVar(&healthcheckOpts.expect, "healthcheck.expect", "", "text which must appear in the reply")
+	flag.DurationVar(&healthcheckOpts.timeout, "healthcheck.timeout", 5*time.Second, "overall timeout for the probe")
+	subcommands["healthcheck"] = healthcheckMain
+}
+
+// A sane reply is at least one whole line, and not absurdly long.
+const healthcheckMaxReply = 1024 * 1024
+
+func healthcheckMain(args []string) int {
+	if len(args) != 0 {
+		fmt.Fprintf(os.Stderr, "%s healthcheck: unexpected arguments: %q\n", fingerProgram, args)
+		return 2
+	}
+	if err := healthcheckProbe(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s healthcheck: FAIL: %v\n", fingerProgram, err)
+		return 1
+	}
+	fmt.Println("ok")
+	return 0
+}
+
+func healthcheckAddress() (network, address string, err error) {
+	if healthcheckOpts.address != "" {
+		if p, ok := strings.CutPrefix(healthcheckOpts.address, "unix:"); ok {
+			return "unix", p, nil
+		}
+		return "tcp", healthcheckOpts.address, nil
+	}
+	if opts.listen == "" && opts.listenEnv == "" && unixOpts.path != "" {
+		return "unix", unixOpts.path, nil
+	}
+	spec, err := deriveListenPort(opts.listen, opts.listenEnv)
+	if err != nil {
+		return "", "", err
+	}
+	host, port, err := net.SplitHostPort(spec)
+	if err != nil {
+		return "", "", err
+	}
+	if host == "" {
+		host = "localhost"
+	}
+	return "tcp", net.JoinHostPort(host, port), nil
+}
+
+func healthcheckProbe() error {
+	network, address, err := healthcheckAddress()
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(healthcheckOpts.timeout)
+	conn, err := net.DialTimeout(network, address, healthcheckOpts.timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(deadline)
+
+	if _, err := conn.Write([]byte(healthcheckOpts.user + "\r\n")); err != nil {
+		return fmt.Errorf("sending probe: %w", err)
+	}
+
+	reply, err := io.ReadAll(bufio.NewReader(io.LimitReader(conn, healthcheckMaxReply+1)))
+	if err != nil {
+		return fmt.Errorf("reading reply: %w", err)
+	}
+	switch {
+	case len(reply) == 0:
+		return fmt.Errorf("empty reply from %s", address)
+	case len(reply) > healthcheckMaxReply:
+		return fmt.Errorf("over-long reply from %s", address)
+	case !bytes.HasSuffix(reply, []byte{'\n'}):
+		return fmt.Errorf("reply from %s not newline-terminated", address)
+	case healthcheckOpts.expect != "" && !bytes.Contains(reply, []byte(healthcheckOpts.expect)):
+		return fmt.Errorf("reply from %s lacks %q", address, healthcheckOpts.expect)
+	}
+	return nil
+}
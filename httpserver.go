@@ -0,0 +1,56 @@
+// Copyright © 2020 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+)
+
+// The HTTP listener is for operators, not the public: it is bound after
+// dropping privileges, so needs an unprivileged port, and should be
+// firewalled off from the world.
+var httpOpts struct {
+	listen string
+}
+
+func init() {
+	flag.StringVar(&httpOpts.listen, "http.listen", "", "address-spec for operational HTTP (/metrics, /healthz, /readyz) (empty to disable)")
+}
+
+// httpMux is populated by init functions, for whatever endpoints we serve.
+var httpMux = http.NewServeMux()
+
+func init() {
+	httpMux.Handle("/metrics", promhttp.Handler())
+}
+
+// startHTTPServer does not block; a failure to serve is logged, but we're a
+// finger server first and foremost, so it does not take us down.
+func startHTTPServer(log logrus.FieldLogger) *http.Server {
+	log = log.WithFields(logrus.Fields{
+		"subsystem": "http",
+		"listen":    httpOpts.listen,
+	})
+	srv := &http.Server{
+		Addr:              httpOpts.listen,
+		Handler:           httpMux,
+		ReadHeaderTimeout: 10 * time.Second,
+		WriteTimeout:      30 * time.Second,
+	}
+	go func() {
+		log.Info("listening")
+		err := srv.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.WithError(err).Warn("HTTP server failed")
+		}
+	}()
+	return srv
+}
@@ -0,0 +1,396 @@
+// Copyright © 2020 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package main
+
+import (
+	"container/list"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/sirupsen/logrus"
+)
+
+// Users can be resolved from an LDAP directory, by default after passwd and
+// before the homes-dir.  Each cache miss is a fresh connection, bind and
+// search: finger is low-volume, and this keeps us out of the business of
+// connection-pool health.  A directory which is down is logged and we carry on
+// as though the user were not in it; errors are not cached, results are.  A
+// name matching more than one entry is an answer, and refused outright, as an
+// ambiguous real name is.  Concurrent misses for the same name share one
+// search.
+//
+// The search is behind ldapSearcher so that something other than a real
+// directory can stand in for it.
+var ldapOpts struct {
+	url          string
+	startTLS     bool
+	caFile       string
+	bindDN       string
+	passwordFile string
+	baseDN       string
+	filter       string
+	attrLogin    string
+	attrUID      string
+	attrHome     string
+	attrName     string
+	showAttrs    string
+	minUID       uint64
+	timeout      time.Duration
+	cacheTTL     time.Duration
+	negativeTTL  time.Duration
+}
+
+func init() {
+	flag.StringVar(&ldapOpts.url, "ldap.url", "", "LDAP server URL, ldap:// or ldaps:// (empty to disable)")
+	flag.BoolVar(&ldapOpts.startTLS, "ldap.starttls", false, "use StartTLS on an ldap:// connection")
+	flag.StringVar(&ldapOpts.caFile, "ldap.ca-file", "", "PEM CA certificates to verify the LDAP server with (default: system roots)")
+	flag.StringVar(&ldapOpts.bindDN, "ldap.bind-dn", "", "DN to bind as (empty for anonymous)")
+	flag.StringVar(&ldapOpts.passwordFile, "ldap.bind-password-file", "", "file holding the password for -ldap.bind-dn")
+	flag.StringVar(&ldapOpts.baseDN, "ldap.base-dn", "", "base DN to search under")
+	flag.StringVar(&ldapOpts.filter, "ldap.filter", "(&(objectClass=posixAccount)(uid=%s))", "search filter; %s is replaced by the escaped username")
+	flag.StringVar(&ldapOpts.attrLogin, "ldap.attr.login", "uid", "attribute holding the login name")
+	flag.StringVar(&ldapOpts.attrUID, "ldap.attr.uid", "uidNumber", "attribute holding the numeric uid")
+	flag.StringVar(&ldapOpts.attrHome, "ldap.attr.home", "homeDirectory", "attribute holding the home-dir")
+	flag.StringVar(&ldapOpts.attrName, "ldap.attr.name", "cn", "attribute holding the real name (for -show.real-name)")
+	flag.StringVar(&ldapOpts.showAttrs, "ldap.show-attrs", "", "comma-separated ATTRIBUTE:CAPTION to show in /W mode")
+	flag.Uint64Var(&ldapOpts.minUID, "ldap.min-uid", 1, "ignore LDAP users with a uid below this")
+	flag.DurationVar(&ldapOpts.timeout, "ldap.timeout", 5*time.Second, "timeout for each LDAP lookup")
+	flag.DurationVar(&ldapOpts.cacheTTL, "ldap.cache-ttl", 5*time.Minute, "how long to cache users found")
+	flag.DurationVar(&ldapOpts.negativeTTL, "ldap.negative-ttl", time.Minute, "how long to cache users not found")
+}
+
+// ldapAccount is what we want from the directory about a user.
+type ldapAccount struct {
+	login    string
+	uid      uint64
+	homeDir  string
+	realName string
+	fields   []userField
+}
+
+type ldapSearcher interface {
+	// searchUser returns found=false, with no error, for no such user, and
+	// errLDAPAmbiguous for a name matching more than one.
+	searchUser(username string) (account ldapAccount, found bool, err error)
+}
+
+// errLDAPAmbiguous is for a name matching more than one entry: like an
+// ambiguous real name, not something to guess about.
+var errLDAPAmbiguous = errors.New("more than one LDAP entry matches")
+
+// ldapBackend is nil unless LDAP is configured.
+var ldapBackend ldapSearcher
+
+// setupLDAP validates the options and sets ldapBackend; the password file and
+// CA file are read per connection, so can be rotated without restart.
+func setupLDAP() error {
+	if ldapOpts.url == "" {
+		return nil
+	}
+	if ldapOpts.baseDN == "" {
+		return errors.New("-ldap.url needs -ldap.base-dn")
+	}
+	if strings.Count(ldapOpts.filter, "%s") != 1 {
+		return fmt.Errorf("-ldap.filter %q must contain %%s exactly once", ldapOpts.filter)
+	}
+	if (ldapOpts.bindDN == "") != (ldapOpts.passwordFile == "") {
+		return errors.New("-ldap.bind-dn and -ldap.bind-password-file go together")
+	}
+	shows, err := parseLDAPShowAttrs(ldapOpts.showAttrs)
+	if err != nil {
+		return err
+	}
+	ldapBackend = newLDAPCache(&ldapDirectory{showAttrs: shows})
+	return nil
+}
+
+func parseLDAPShowAttrs(spec string) ([][2]string, error) {
+	var out [][2]string
+	for item := range strings.SplitSeq(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		attr, caption, ok := strings.Cut(item, ":")
+		if !ok || attr == "" || caption == "" {
+			return nil, fmt.Errorf("-ldap.show-attrs item %q: want ATTRIBUTE:CAPTION", item)
+		}
+		out = append(out, [2]string{attr, caption})
+	}
+	return out, nil
+}
+
+// ldapDirectory is the real thing.
+type ldapDirectory struct {
+	showAttrs [][2]string
+}
+
+func (d *ldapDirectory) tlsConfig(host string) (*tls.Config, error) {
+	cfg := &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}
+	if ldapOpts.caFile != "" {
+		pem, err := os.ReadFile(ldapOpts.caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", ldapOpts.caFile)
+		}
+	}
+	return cfg, nil
+}
+
+func (d *ldapDirectory) connect() (*ldap.Conn, error) {
+	host := ""
+	if i := strings.Index(ldapOpts.url, "://"); i >= 0 {
+		host = ldapOpts.url[i+3:]
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.TrimSuffix(host, "/")
+	}
+	tlsCfg, err := d.tlsConfig(host)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := ldap.DialURL(ldapOpts.url,
+		ldap.DialWithDialer(&net.Dialer{Timeout: ldapOpts.timeout}),
+		ldap.DialWithTLSConfig(tlsCfg))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(ldapOpts.timeout)
+	if ldapOpts.startTLS {
+		if err := conn.StartTLS(tlsCfg); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("StartTLS: %w", err)
+		}
+	}
+	if ldapOpts.bindDN != "" {
+		pw, err := os.ReadFile(ldapOpts.passwordFile)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if err := conn.Bind(ldapOpts.bindDN, strings.TrimRight(string(pw), "\r\n")); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("bind: %w", err)
+		}
+	}
+	return conn, nil
+}
+
+func (d *ldapDirectory) searchUser(username string) (ldapAccount, bool, error) {
+	conn, err := d.connect()
+	if err != nil {
+		return ldapAccount{}, false, err
+	}
+	defer conn.Close()
+
+	attrs := []string{ldapOpts.attrLogin, ldapOpts.attrUID, ldapOpts.attrHome, ldapOpts.attrName}
+	for _, sa := range d.showAttrs {
+		attrs = append(attrs, sa[0])
+	}
+	req := ldap.NewSearchRequest(ldapOpts.baseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		2, int(ldapOpts.timeout/time.Second), false,
+		strings.Replace(ldapOpts.filter, "%s", ldap.EscapeFilter(username), 1),
+		attrs, nil)
+	res, err := conn.Search(req)
+	switch {
+	case ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded):
+		// more than the two we asked for, or than the server will give us
+		return ldapAccount{}, false, errLDAPAmbiguous
+	case err != nil:
+		return ldapAccount{}, false, err
+	}
+	if res == nil {
+		return ldapAccount{}, false, nil
+	}
+	return d.accountFromEntries(res.Entries)
+}
+
+// accountFromEntries maps the search results onto an account.
+func (d *ldapDirectory) accountFromEntries(entries []*ldap.Entry) (ldapAccount, bool, error) {
+	switch len(entries) {
+	case 0:
+		return ldapAccount{}, false, nil
+	case 1:
+	default:
+		return ldapAccount{}, false, errLDAPAmbiguous
+	}
+
+	e := entries[0]
+	acct := ldapAccount{
+		login:    e.GetAttributeValue(ldapOpts.attrLogin),
+		homeDir:  e.GetAttributeValue(ldapOpts.attrHome),
+		realName: e.GetAttributeValue(ldapOpts.attrName),
+	}
+	var err error
+	acct.uid, err = strconv.ParseUint(e.GetAttributeValue(ldapOpts.attrUID), 10, 32)
+	if err != nil {
+		return ldapAccount{}, false, fmt.Errorf("entry %q: bad %s: %w", e.DN, ldapOpts.attrUID, err)
+	}
+	for _, sa := range d.showAttrs {
+		if v := e.GetAttributeValue(sa[0]); v != "" {
+			acct.fields = append(acct.fields, userField{caption: sa[1], value: v})
+		}
+	}
+	return acct, true, nil
+}
+
+// ldapCache remembers answers, both yes and no, for a while.  It's bounded
+// against someone enumerating names, dropping the least recently used.
+type ldapCache struct {
+	searcher ldapSearcher
+	sync.Mutex
+	entries  map[string]*list.Element // of *ldapCacheEntry
+	recency  list.List                // most recently used at the front
+	inFlight map[string]*ldapSearch
+}
+
+type ldapCacheEntry struct {
+	username  string
+	account   ldapAccount
+	found     bool
+	ambiguous bool
+	expires   time.Time
+}
+
+// ldapSearch is one search, whose result is shared with everyone who asked
+// for the same name while it was running.
+type ldapSearch struct {
+	done    chan struct{}
+	account ldapAccount
+	found   bool
+	err     error
+}
+
+const ldapCacheMaxEntries = 10000
+
+func newLDAPCache(searcher ldapSearcher) *ldapCache {
+	return &ldapCache{
+		searcher: searcher,
+		entries:  make(map[string]*list.Element),
+		inFlight: make(map[string]*ldapSearch),
+	}
+}
+
+// searchUser caches errLDAPAmbiguous, for the negative TTL, as it's an
+// answer from the directory; other errors are not cached.
+func (lc *ldapCache) searchUser(username string) (ldapAccount, bool, error) {
+	now := time.Now()
+	lc.Lock()
+	if el, ok := lc.entries[username]; ok {
+		ce := el.Value.(*ldapCacheEntry)
+		if now.Before(ce.expires) {
+			lc.recency.MoveToFront(el)
+			lc.Unlock()
+			if ce.ambiguous {
+				return ldapAccount{}, false, errLDAPAmbiguous
+			}
+			return ce.account, ce.found, nil
+		}
+		lc.remove(el)
+	}
+	if s, ok := lc.inFlight[username]; ok {
+		lc.Unlock()
+		<-s.done
+		return s.account, s.found, s.err
+	}
+	s := &ldapSearch{done: make(chan struct{})}
+	lc.inFlight[username] = s
+	lc.Unlock()
+
+	s.account, s.found, s.err = lc.searcher.searchUser(username)
+
+	ttl := ldapOpts.cacheTTL
+	if !s.found {
+		ttl = ldapOpts.negativeTTL
+	}
+	ambiguous := errors.Is(s.err, errLDAPAmbiguous)
+	lc.Lock()
+	delete(lc.inFlight, username)
+	if (s.err == nil || ambiguous) && ttl > 0 {
+		lc.add(&ldapCacheEntry{username: username, account: s.account, found: s.found, ambiguous: ambiguous, expires: now.Add(ttl)})
+	}
+	lc.Unlock()
+	close(s.done)
+	return s.account, s.found, s.err
+}
+
+// add and remove are called with the lock held.
+func (lc *ldapCache) add(ce *ldapCacheEntry) {
+	lc.entries[ce.username] = lc.recency.PushFront(ce)
+	for len(lc.entries) > ldapCacheMaxEntries {
+		lc.remove(lc.recency.Back())
+	}
+}
+
+func (lc *ldapCache) remove(el *list.Element) {
+	delete(lc.entries, el.Value.(*ldapCacheEntry).username)
+	lc.recency.Remove(el)
+}
+
+func init() {
+	registerResolver("ldap", resolverFunc(resolveLDAP))
+}
+
+func resolveLDAP(q *userQuery) (fingerUser, resolution) {
+	if ldapBackend == nil {
+		return fingerUser{}, resolveNext
+	}
+	f, ok, authoritative := findUserByLDAP(q.username, q.log)
+	if !authoritative {
+		q.log.Debug("LDAP lookup not authoritative, continuing")
+	}
+	return f, authoritativeResolution(ok, authoritative)
+}
+
+// findUserByLDAP has the same contract as findUserByPasswd: authoritative
+// means that the directory has answered and we shouldn't look elsewhere.
+func findUserByLDAP(username string, log logrus.FieldLogger) (
+	result fingerUser,
+	ok bool,
+	authoritative bool,
+) {
+	acct, found, err := ldapBackend.searchUser(username)
+	switch {
+	case errors.Is(err, errLDAPAmbiguous):
+		// the directory has answered; it's not for another source to guess
+		log.Info("LDAP lookup ambiguous, treating as unknown")
+		return fingerUser{}, false, true
+	case err != nil:
+		log.WithError(err).Warn("LDAP lookup failed")
+		return fingerUser{}, false, false
+	}
+	if !found {
+		return fingerUser{}, false, false
+	}
+	log = log.WithField("ldap-login", acct.login)
+	if acct.uid < ldapOpts.minUID || acct.uid == 0 {
+		return fingerUser{}, false, true
+	}
+	if acct.homeDir == "" || !strings.HasPrefix(acct.homeDir, "/") {
+		log.WithField("home", acct.homeDir).Info("LDAP user has no usable home-dir")
+		return fingerUser{}, false, true
+	}
+	result, ok, authoritative = passwdUserHome(uint32(acct.uid), acct.homeDir, log)
+	if ok {
+		result.realName = acct.realName
+		result.extraFields = acct.fields
+	}
+	return result, ok, authoritative
+}
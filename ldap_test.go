@@ -0,0 +1,663 @@
+// Copyright © 2020 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/sirupsen/logrus"
+)
+
+// fakeDirectory answers from a map, counting searches; a name mapped to
+// nothing is ambiguous.
+type fakeDirectory struct {
+	accounts map[string]*ldapAccount
+	searches atomic.Int32
+	release  chan struct{} // if set, searches wait for it
+}
+
+func (fd *fakeDirectory) searchUser(username string) (ldapAccount, bool, error) {
+	fd.searches.Add(1)
+	if fd.release != nil {
+		<-fd.release
+	}
+	acct, ok := fd.accounts[username]
+	switch {
+	case !ok:
+		return ldapAccount{}, false, nil
+	case acct == nil:
+		return ldapAccount{}, false, errLDAPAmbiguous
+	}
+	return *acct, true, nil
+}
+
+func withLDAPOpts(t *testing.T) {
+	t.Helper()
+	saved := ldapOpts
+	t.Cleanup(func() { ldapOpts = saved })
+	ldapOpts.cacheTTL = time.Hour
+	ldapOpts.negativeTTL = time.Hour
+	ldapOpts.minUID = 1000
+}
+
+func TestLDAPCache(t *testing.T) {
+	withLDAPOpts(t)
+	ldapOpts.negativeTTL = 50 * time.Millisecond
+	fd := &fakeDirectory{accounts: map[string]*ldapAccount{
+		"alice": {login: "alice", uid: 1001, homeDir: "/home/alice"},
+		"dup":   nil,
+	}}
+	lc := newLDAPCache(fd)
+
+	search := func(name string, wantFound bool, wantErr error, wantSearches int32) {
+		t.Helper()
+		_, found, err := lc.searchUser(name)
+		if found != wantFound || !errors.Is(err, wantErr) {
+			t.Fatalf("%s: found=%v err=%v, want found=%v err=%v", name, found, err, wantFound, wantErr)
+		}
+		if got := fd.searches.Load(); got != wantSearches {
+			t.Fatalf("%s: %d searches, want %d", name, got, wantSearches)
+		}
+	}
+
+	search("alice", true, nil, 1)
+	search("alice", true, nil, 1) // hit
+	search("bob", false, nil, 2)
+	search("bob", false, nil, 2) // negative hit
+	search("dup", false, errLDAPAmbiguous, 3)
+	search("dup", false, errLDAPAmbiguous, 3) // ambiguity is cached too
+
+	time.Sleep(60 * time.Millisecond)
+	search("bob", false, nil, 4) // negative expired
+	search("alice", true, nil, 4)
+}
+
+func TestLDAPCacheErrorsNotCached(t *testing.T) {
+	withLDAPOpts(t)
+	fails := &failingDirectory{}
+	lc := newLDAPCache(fails)
+	for range 2 {
+		if _, _, err := lc.searchUser("alice"); err == nil {
+			t.Fatal("no error")
+		}
+	}
+	if fails.searches != 2 {
+		t.Fatalf("%d searches, want 2", fails.searches)
+	}
+}
+
+type failingDirectory struct{ searches int }
+
+func (fd *failingDirectory) searchUser(string) (ldapAccount, bool, error) {
+	fd.searches++
+	return ldapAccount{}, false, errors.New("directory down")
+}
+
+func TestLDAPCacheEviction(t *testing.T) {
+	withLDAPOpts(t)
+	fd := &fakeDirectory{}
+	lc := newLDAPCache(fd)
+	for i := range ldapCacheMaxEntries {
+		_, _, _ = lc.searchUser(fmt.Sprint("user", i))
+	}
+	_, _, _ = lc.searchUser("user0") // now most recently used
+	_, _, _ = lc.searchUser("one-more")
+	if len(lc.entries) != ldapCacheMaxEntries || lc.recency.Len() != ldapCacheMaxEntries {
+		t.Fatalf("%d entries, %d in recency list, want %d", len(lc.entries), lc.recency.Len(), ldapCacheMaxEntries)
+	}
+	if _, ok := lc.entries["user1"]; ok {
+		t.Error("least recently used entry not evicted")
+	}
+	for _, name := range []string{"user0", "user2", "one-more"} {
+		if _, ok := lc.entries[name]; !ok {
+			t.Errorf("%s evicted", name)
+		}
+	}
+}
+
+func TestLDAPCacheSharedSearch(t *testing.T) {
+	withLDAPOpts(t)
+	fd := &fakeDirectory{
+		accounts: map[string]*ldapAccount{"alice": {login: "alice", uid: 1001}},
+		release:  make(chan struct{}),
+	}
+	lc := newLDAPCache(fd)
+
+	const askers = 10
+	var wg sync.WaitGroup
+	results := make(chan bool, askers)
+	for range askers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, found, _ := lc.searchUser("alice")
+			results <- found
+		}()
+	}
+	// Let them all reach the cache before the search finishes.
+	for {
+		lc.Lock()
+		waiting := lc.inFlight["alice"] != nil
+		lc.Unlock()
+		if waiting {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(fd.release)
+	wg.Wait()
+	close(results)
+
+	for found := range results {
+		if !found {
+			t.Error("an asker didn't get the shared result")
+		}
+	}
+	if got := fd.searches.Load(); got != 1 {
+		t.Errorf("%d searches, want 1", got)
+	}
+}
+
+func TestLDAPAccountFromEntries(t *testing.T) {
+	withLDAPOpts(t)
+	ldapOpts.attrLogin = "uid"
+	ldapOpts.attrUID = "uidNumber"
+	ldapOpts.attrHome = "homeDirectory"
+	ldapOpts.attrName = "cn"
+	d := &ldapDirectory{showAttrs: [][2]string{{"telephoneNumber", "Phone"}, {"roomNumber", "Room"}}}
+
+	alice := ldap.NewEntry("uid=alice,ou=people,dc=example,dc=org", map[string][]string{
+		"uid":             {"alice"},
+		"uidNumber":       {"1001"},
+		"homeDirectory":   {"/home/alice"},
+		"cn":              {"Alice Example"},
+		"telephoneNumber": {"+1 555 0100"},
+	})
+	acct, found, err := d.accountFromEntries([]*ldap.Entry{alice})
+	if err != nil || !found {
+		t.Fatalf("found=%v err=%v", found, err)
+	}
+	want := ldapAccount{
+		login:    "alice",
+		uid:      1001,
+		homeDir:  "/home/alice",
+		realName: "Alice Example",
+		fields:   []userField{{caption: "Phone", value: "+1 555 0100"}},
+	}
+	if !reflect.DeepEqual(acct, want) {
+		t.Errorf("got %+v, want %+v", acct, want)
+	}
+
+	if _, found, err := d.accountFromEntries(nil); found || err != nil {
+		t.Errorf("no entries: found=%v err=%v", found, err)
+	}
+	if _, _, err := d.accountFromEntries([]*ldap.Entry{alice, alice}); !errors.Is(err, errLDAPAmbiguous) {
+		t.Errorf("two entries: err=%v", err)
+	}
+	bad := ldap.NewEntry("uid=bad,dc=example,dc=org", map[string][]string{"uid": {"bad"}, "uidNumber": {"x"}})
+	if _, _, err := d.accountFromEntries([]*ldap.Entry{bad}); err == nil {
+		t.Error("bad uidNumber accepted")
+	}
+}
+
+func TestFindUserByLDAP(t *testing.T) {
+	withLDAPOpts(t)
+	saved := ldapBackend
+	defer func() { ldapBackend = saved }()
+
+	home := t.TempDir()
+	fields := []userField{{caption: "Room", value: "101"}}
+	ldapBackend = newLDAPCache(&fakeDirectory{accounts: map[string]*ldapAccount{
+		"alice":  {login: "alice", uid: 1001, homeDir: home, realName: "Alice Example", fields: fields},
+		"system": {login: "system", uid: 999, homeDir: home},
+		"root":   {login: "root", uid: 0, homeDir: home},
+		"nohome": {login: "nohome", uid: 1002, homeDir: "relative"},
+		"dup":    nil,
+	}})
+	logger := logrus.New()
+	logger.Out = io.Discard
+	log := logrus.NewEntry(logger)
+
+	for _, tc := range []struct {
+		name              string
+		ok, authoritative bool
+	}{
+		{"alice", true, true},
+		{"system", false, true},
+		{"root", false, true},
+		{"nohome", false, true},
+		{"missing", false, false},
+		{"dup", false, true},
+	} {
+		f, ok, authoritative := findUserByLDAP(tc.name, log)
+		if ok != tc.ok || authoritative != tc.authoritative {
+			t.Errorf("%s: ok=%v authoritative=%v, want %v %v", tc.name, ok, authoritative, tc.ok, tc.authoritative)
+		}
+		if tc.name == "alice" && (f.uid != 1001 || f.homeDir != home || f.realName != "Alice Example" || !reflect.DeepEqual(f.extraFields, fields)) {
+			t.Errorf("alice mapped to %+v", f)
+		}
+	}
+}
+
+// ldapStandIn is just enough of an LDAP server, on loopback, to put
+// ldapDirectory through its paces: simple bind, StartTLS or LDAPS, and
+// searches answered by the value asserted for "uid" in the filter, with the
+// size limit honoured as a real server would.
+type ldapStandIn struct {
+	t        *testing.T
+	ln       net.Listener
+	scheme   string
+	tlsCfg   *tls.Config
+	bindDN   string
+	password string
+	entries  map[string][]*ldap.Entry
+
+	wg       sync.WaitGroup
+	mu       sync.Mutex
+	conns    []net.Conn
+	binds    []string // DNs bound as, successfully
+	filters  []string // as decompiled, so escaped
+	plainOps int      // searches and binds made without TLS
+}
+
+const (
+	standInPlain    = "plain"
+	standInLDAPS    = "ldaps"
+	standInStartTLS = "starttls"
+)
+
+func newLDAPStandIn(t *testing.T, mode string, cert tls.Certificate) *ldapStandIn {
+	t.Helper()
+	s := &ldapStandIn{
+		t:        t,
+		tlsCfg:   &tls.Config{Certificates: []tls.Certificate{cert}},
+		bindDN:   "cn=fingerd,dc=example,dc=org",
+		password: "s3cret",
+		entries:  make(map[string][]*ldap.Entry),
+		scheme:   "ldap",
+	}
+	var err error
+	if mode == standInLDAPS {
+		s.scheme = "ldaps"
+		s.ln, err = tls.Listen("tcp", "127.0.0.1:0", s.tlsCfg)
+	} else {
+		s.ln, err = net.Listen("tcp", "127.0.0.1:0")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode == standInPlain {
+		s.tlsCfg = nil // refuse StartTLS
+	}
+	t.Cleanup(s.close)
+	s.wg.Add(1)
+	go s.serve()
+	return s
+}
+
+func (s *ldapStandIn) url() string {
+	return s.scheme + "://" + s.ln.Addr().String()
+}
+
+func (s *ldapStandIn) add(uid string, entry *ldap.Entry) {
+	s.entries[uid] = append(s.entries[uid], entry)
+}
+
+func (s *ldapStandIn) close() {
+	s.ln.Close()
+	s.mu.Lock()
+	for _, c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+func (s *ldapStandIn) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns = append(s.conns, conn)
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer conn.Close()
+			s.handle(conn)
+		}()
+	}
+}
+
+func (s *ldapStandIn) handle(conn net.Conn) {
+	_, secure := conn.(*tls.Conn)
+	for {
+		msg, err := ber.ReadPacket(conn)
+		if err != nil || len(msg.Children) < 2 {
+			return
+		}
+		id := msg.Children[0].Value.(int64)
+		op := msg.Children[1]
+		if !secure && op.Tag != ldap.ApplicationExtendedRequest {
+			s.mu.Lock()
+			s.plainOps++
+			s.mu.Unlock()
+		}
+		switch op.Tag {
+		case ldap.ApplicationUnbindRequest:
+			return
+
+		case ldap.ApplicationBindRequest:
+			dn := op.Children[1].Data.String()
+			code := int64(ldap.LDAPResultSuccess)
+			if dn != s.bindDN || op.Children[2].Data.String() != s.password {
+				code = ldap.LDAPResultInvalidCredentials
+			} else {
+				s.mu.Lock()
+				s.binds = append(s.binds, dn)
+				s.mu.Unlock()
+			}
+			s.send(conn, id, ldapResultPacket(ldap.ApplicationBindResponse, code))
+
+		case ldap.ApplicationExtendedRequest:
+			if s.tlsCfg == nil || secure {
+				s.send(conn, id, ldapResultPacket(ldap.ApplicationExtendedResponse, ldap.LDAPResultProtocolError))
+				continue
+			}
+			s.send(conn, id, ldapResultPacket(ldap.ApplicationExtendedResponse, ldap.LDAPResultSuccess))
+			tc := tls.Server(conn, s.tlsCfg)
+			if tc.Handshake() != nil {
+				return
+			}
+			conn, secure = tc, true
+
+		case ldap.ApplicationSearchRequest:
+			sizeLimit := op.Children[3].Value.(int64)
+			filter, err := ldap.DecompileFilter(op.Children[6])
+			if err != nil {
+				s.send(conn, id, ldapResultPacket(ldap.ApplicationSearchResultDone, ldap.LDAPResultProtocolError))
+				continue
+			}
+			s.mu.Lock()
+			s.filters = append(s.filters, filter)
+			s.mu.Unlock()
+			matches := s.entries[equalityValue(op.Children[6], "uid")]
+			code := int64(ldap.LDAPResultSuccess)
+			if sizeLimit > 0 && int64(len(matches)) > sizeLimit {
+				matches, code = matches[:sizeLimit], ldap.LDAPResultSizeLimitExceeded
+			}
+			for _, e := range matches {
+				s.send(conn, id, entryPacket(e))
+			}
+			s.send(conn, id, ldapResultPacket(ldap.ApplicationSearchResultDone, code))
+
+		default:
+			return
+		}
+	}
+}
+
+func (s *ldapStandIn) send(conn net.Conn, id int64, op *ber.Packet) {
+	msg := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	msg.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "MessageID"))
+	msg.AppendChild(op)
+	_, _ = conn.Write(msg.Bytes())
+}
+
+func ldapResultPacket(tag ber.Tag, code int64) *ber.Packet {
+	p := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Result")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, "resultCode"))
+	p.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matchedDN"))
+	p.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "diagnosticMessage"))
+	return p
+}
+
+func entryPacket(e *ldap.Entry) *ber.Packet {
+	p := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Entry")
+	p.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.DN, "objectName"))
+	attrs := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "attributes")
+	for _, a := range e.Attributes {
+		ap := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "attribute")
+		ap.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, a.Name, "type"))
+		vals := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "vals")
+		for _, v := range a.Values {
+			vals.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, "value"))
+		}
+		ap.AppendChild(vals)
+		attrs.AppendChild(ap)
+	}
+	p.AppendChild(attrs)
+	return p
+}
+
+// equalityValue finds the value asserted for attr anywhere in the filter.
+func equalityValue(filter *ber.Packet, attr string) string {
+	if filter.ClassType == ber.ClassContext && filter.Tag == ldap.FilterEqualityMatch && len(filter.Children) == 2 {
+		if strings.EqualFold(filter.Children[0].Data.String(), attr) {
+			return filter.Children[1].Data.String()
+		}
+		return ""
+	}
+	for _, child := range filter.Children {
+		if v := equalityValue(child, attr); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// testCertificate is a self-signed certificate for 127.0.0.1, and a file
+// holding it for use as -ldap.ca-file.
+func testCertificate(t *testing.T) (tls.Certificate, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fingerd test directory"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, caFile
+}
+
+// withLDAPDirectoryOpts points ldapOpts at the stand-in, with the defaults
+// for everything about the search.
+func withLDAPDirectoryOpts(t *testing.T, s *ldapStandIn, caFile string) {
+	t.Helper()
+	withLDAPOpts(t)
+	passwordFile := filepath.Join(t.TempDir(), "ldap.secret")
+	if err := os.WriteFile(passwordFile, []byte(s.password+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ldapOpts.url = s.url()
+	ldapOpts.startTLS = false
+	ldapOpts.caFile = caFile
+	ldapOpts.bindDN = s.bindDN
+	ldapOpts.passwordFile = passwordFile
+	ldapOpts.baseDN = "ou=people,dc=example,dc=org"
+	ldapOpts.filter = flag.Lookup("ldap.filter").DefValue
+	ldapOpts.attrLogin = "uid"
+	ldapOpts.attrUID = "uidNumber"
+	ldapOpts.attrHome = "homeDirectory"
+	ldapOpts.attrName = "cn"
+	ldapOpts.timeout = 5 * time.Second
+}
+
+func personEntry(uid, uidNumber string) *ldap.Entry {
+	return ldap.NewEntry("uid="+uid+",ou=people,dc=example,dc=org", map[string][]string{
+		"uid":           {uid},
+		"uidNumber":     {uidNumber},
+		"homeDirectory": {"/home/" + uid},
+		"cn":            {"Person " + uidNumber},
+		"roomNumber":    {"R" + uidNumber},
+	})
+}
+
+func TestLDAPDirectory(t *testing.T) {
+	cert, caFile := testCertificate(t)
+	for _, mode := range []string{standInPlain, standInLDAPS, standInStartTLS} {
+		t.Run(mode, func(t *testing.T) {
+			s := newLDAPStandIn(t, mode, cert)
+			s.add("alice", personEntry("alice", "1001"))
+			s.add("dup", personEntry("dup", "1002"))
+			s.add("dup", personEntry("dup", "1003"))
+			for _, n := range []string{"1004", "1005", "1006"} {
+				s.add("many", personEntry("many", n))
+			}
+			withLDAPDirectoryOpts(t, s, caFile)
+			ldapOpts.startTLS = mode == standInStartTLS
+			d := &ldapDirectory{showAttrs: [][2]string{{"roomNumber", "Room"}}}
+
+			acct, found, err := d.searchUser("alice")
+			if err != nil || !found {
+				t.Fatalf("alice: found=%v err=%v", found, err)
+			}
+			want := ldapAccount{
+				login:    "alice",
+				uid:      1001,
+				homeDir:  "/home/alice",
+				realName: "Person 1001",
+				fields:   []userField{{caption: "Room", value: "R1001"}},
+			}
+			if !reflect.DeepEqual(acct, want) {
+				t.Errorf("alice: got %+v, want %+v", acct, want)
+			}
+
+			if _, found, err := d.searchUser("nobody"); found || err != nil {
+				t.Errorf("nobody: found=%v err=%v", found, err)
+			}
+			// two entries fit the size limit of two; three go past it
+			for _, name := range []string{"dup", "many"} {
+				if _, _, err := d.searchUser(name); !errors.Is(err, errLDAPAmbiguous) {
+					t.Errorf("%s: err=%v, want ambiguous", name, err)
+				}
+			}
+
+			// The username can't change the shape of the filter.
+			if _, found, err := d.searchUser("a*)(uid=*"); found || err != nil {
+				t.Errorf("injection: found=%v err=%v", found, err)
+			}
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			wantFilter := `(&(objectClass=posixAccount)(uid=a\2a\29\28uid=\2a))`
+			if got := s.filters[len(s.filters)-1]; got != wantFilter {
+				t.Errorf("filter %q, want %q", got, wantFilter)
+			}
+			if len(s.binds) != 5 {
+				t.Errorf("%d binds, want one per search", len(s.binds))
+			}
+			if mode != standInPlain && s.plainOps != 0 {
+				t.Errorf("%d operations made before TLS", s.plainOps)
+			}
+		})
+	}
+}
+
+func TestLDAPDirectoryFailures(t *testing.T) {
+	cert, caFile := testCertificate(t)
+	s := newLDAPStandIn(t, standInPlain, cert)
+	s.add("alice", personEntry("alice", "1001"))
+	d := &ldapDirectory{}
+
+	for _, tc := range []struct {
+		name  string
+		setup func()
+	}{
+		{"wrong password", func() {
+			if err := os.WriteFile(ldapOpts.passwordFile, []byte("guess\n"), 0o600); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"missing password file", func() { ldapOpts.passwordFile += ".missing" }},
+		{"StartTLS refused", func() { ldapOpts.startTLS = true }},
+		{"nothing listening", func() { ldapOpts.url = "ldap://127.0.0.1:1" }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			withLDAPDirectoryOpts(t, s, caFile)
+			tc.setup()
+			_, found, err := d.searchUser("alice")
+			if err == nil || found || errors.Is(err, errLDAPAmbiguous) {
+				t.Fatalf("found=%v err=%v, want a plain error", found, err)
+			}
+		})
+	}
+
+	// An LDAPS server we can't verify is an error, not a fallback.
+	untrusted := newLDAPStandIn(t, standInLDAPS, cert)
+	withLDAPDirectoryOpts(t, untrusted, "")
+	if _, _, err := d.searchUser("alice"); err == nil {
+		t.Error("unverified server accepted")
+	}
+}
+
+// Through the resolver: a directory which can't pick one user stops the
+// search, while one which can't be reached lets it carry on.
+func TestFindUserByLDAPDirectory(t *testing.T) {
+	cert, caFile := testCertificate(t)
+	s := newLDAPStandIn(t, standInStartTLS, cert)
+	s.add("dup", personEntry("dup", "1002"))
+	s.add("dup", personEntry("dup", "1003"))
+	withLDAPDirectoryOpts(t, s, caFile)
+	ldapOpts.startTLS = true
+
+	saved := ldapBackend
+	defer func() { ldapBackend = saved }()
+	ldapBackend = newLDAPCache(&ldapDirectory{})
+	logger := logrus.New()
+	logger.Out = io.Discard
+	log := logrus.NewEntry(logger)
+
+	for range 2 { // the second from the cache
+		if _, ok, authoritative := findUserByLDAP("dup", log); ok || !authoritative {
+			t.Errorf("ambiguous: ok=%v authoritative=%v, want refused", ok, authoritative)
+		}
+	}
+	ldapOpts.url = "ldap://127.0.0.1:1"
+	if _, ok, authoritative := findUserByLDAP("alice", log); ok || authoritative {
+		t.Errorf("unreachable: ok=%v authoritative=%v, want fall-through", ok, authoritative)
+	}
+}
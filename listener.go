@@ -6,6 +6,7 @@ package main
 
 import (
 	"bufio"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
@@ -13,6 +14,7 @@ import (
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -22,46 +24,71 @@ var (
 	aLongTimeAgo = time.Unix(1, 0)
 )
 
-// A DeadlineableTCPListener is a TCP listener which can be set to abort any extant listen(2) calls.
-// A *net.TCPListener should satisfy this interface.
+// Listener modes; these are passed across re-exec so must not contain
+// colons or newlines.
+const (
+	listenModePlain = "plain"
+	listenModeTLS   = "tls"
+)
+
+// A DeadlineableListener is a stream listener which can be set to abort any extant listen(2) calls.
+// Both *net.TCPListener and *net.UnixListener should satisfy this interface.
 //
 // Golang does after all have a way to abort a current listen(2) call for a new
 // connection; you can change the read timeout on the socket and existing
 // listen(2) calls will return if need be.  So we don't need to periodically
 // awaken to check if we're exiting.
-type DeadlineableTCPListener interface {
-	AcceptTCP() (*net.TCPConn, error)
+type DeadlineableListener interface {
+	Accept() (net.Conn, error)
 	File() (*os.File, error)
 	SetDeadline(time.Time) error
 	Addr() net.Addr
 	Close() error
 }
 
-// TCPFingerListener wraps up everything around listening for connections on a
-// per-protocol basis.  We do not assume sockets accept both IPv4 and IPv6, so
-// instead individually explicitly bind each.  (That's a portability issue, the
-// BSDs switched to blocking both by default on a v6 socket, Linux still does
-// both by default, and both allow this default to by changed via sysctl/proc,
-// or on a per-socket basis.)
-type TCPFingerListener struct {
+// FingerListener wraps up everything around listening for connections on a
+// per-protocol basis.  The networkFamily is "tcp4", "tcp6" or "unix".  We do
+// not assume sockets accept both IPv4 and IPv6, so instead individually
+// explicitly bind each.  (That's a portability issue, the BSDs switched to
+// blocking both by default on a v6 socket, Linux still does both by default,
+// and both allow this default to by changed via sysctl/proc, or on a
+// per-socket basis.)
+type FingerListener struct {
 	// The logger is only used after entering into spawned go-routines;
 	// within the main control, errors are returned to the caller to log as
 	// appropriate
 	*logrus.Entry
 
 	networkFamily string
+	mode          string
 	active        *sync.WaitGroup
 	shuttingDown  <-chan struct{}
-	tcpListener   DeadlineableTCPListener
+	listener      DeadlineableListener
+	// tlsConfig is set iff mode is listenModeTLS
+	tlsConfig *tls.Config
 }
 
-// TCPFingerConnection is the state for one connection.  It has fields which
+// FingerConnection is the state for one connection.  It has fields which
 // mutate on a per-user basis when handling multiple user-names on one
 // connection.
-type TCPFingerConnection struct {
+type FingerConnection struct {
 	*logrus.Entry
-	conn *net.TCPConn
-	l    *TCPFingerListener
+	// conn is the accepted *net.TCPConn or *net.UnixConn, or a *tls.Conn
+	// wrapping it (perhaps via a bufferedConn, after a PROXY header)
+	conn net.Conn
+	l    *FingerListener
+	// remote is the client, which is the socket peer unless a trusted proxy
+	// has told us otherwise; use this, not conn.RemoteAddr(), for decisions.
+	remote net.Addr
+	// limitPeer is what the per-IP connection limit was taken against, or
+	// nil while a proxy's client is still to be named; release with this.
+	limitPeer  net.Addr
+	acceptedAt time.Time
+	// cutOff is set if shutdown closed the socket under us
+	cutOff atomic.Bool
+	// cfg is the settings as of accept, so a reload mid-request can't give
+	// us a mixture of old and new.
+	cfg *settings
 
 	// Did the request use CRLF?  It should have, but if not then adapt and don't send back CRLF lines.
 	crlf bool
@@ -73,30 +100,47 @@ type TCPFingerConnection struct {
 	homeDir  string
 	// Set if we expect the uid to be a certain value, as a security test
 	uid uint32 // fgrep Uid syscall/ztypes_*
+	// Set if the owner of files is not to be checked at all
+	anyOwner bool
+	// How many user@host names in the request we've tried to forward
+	forwards int
 	// writeError says "we've seen an error writing, abort abort
 	writeError bool
 }
 
-// NewTCPFingerListener wraps up the normal path for creating a finger listener.
+// NewFingerListener wraps up the normal path for creating a finger listener.
 // Note that we can also manually construct the type via inheritedListeners() for
 // when we've re-exec'd ourselves.
-func NewTCPFingerListener(
+//
+// The mode should be one of the listenMode constants; for listenModeTLS the
+// listen spec is taken from -tls.listen instead of -listen.
+func NewFingerListener(
 	networkFamily string,
+	mode string,
 	wg *sync.WaitGroup,
 	shuttingDown <-chan struct{},
 	logger *logrus.Logger,
-) (*TCPFingerListener, error) {
+) (*FingerListener, error) {
 	var (
-		err error
-		ok  bool
+		err      error
+		ok       bool
+		portSpec string
 	)
-	fl := &TCPFingerListener{
+	fl := &FingerListener{
 		networkFamily: networkFamily,
+		mode:          mode,
 		active:        wg,
 		shuttingDown:  shuttingDown,
 	}
 
-	portSpec, err := deriveListenPort()
+	switch mode {
+	case listenModePlain:
+		portSpec, err = deriveListenPort(opts.listen, opts.listenEnv)
+	case listenModeTLS:
+		portSpec, err = deriveListenPort(tlsOpts.listen, "")
+	default:
+		err = fmt.Errorf("unknown listener mode %q", mode)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -106,36 +150,46 @@ func NewTCPFingerListener(
 		return nil, err
 	}
 
-	fl.tcpListener, ok = listener.(*net.TCPListener)
+	fl.listener, ok = listener.(*net.TCPListener)
 	if !ok {
 		return nil, fmt.Errorf("listened in %q on %s but did not get a TCP listener (but instead a %T)",
-			fl.networkFamily, opts.listen, listener)
+			fl.networkFamily, portSpec, listener)
 	}
 
+	fl.setupAfterListen(logger)
+	return fl, nil
+}
+
+// setupAfterListen populates the fields which are derived from the mode and
+// the listening socket, common to all ways of getting a listener.
+func (fl *FingerListener) setupAfterListen(logger *logrus.Logger) {
+	if fl.mode == listenModeTLS {
+		fl.tlsConfig = newTLSServerConfig()
+	}
 	fl.Entry = logger.WithFields(logrus.Fields{
 		"family": fl.networkFamily,
-		"accept": fl.tcpListener.Addr(),
+		"mode":   fl.mode,
+		"accept": fl.listener.Addr(),
 		"pid":    os.Getpid(),
 	})
-	return fl, nil
 }
 
 // deriveListenPort encapsulates logic for turning the human's flag-provided
 // listen specs into a string suitable for Go.
-// -listen-env takes precedence over -listen.
-func deriveListenPort() (string, error) {
+// A non-empty envName takes precedence over the spec.
+func deriveListenPort(spec, envName string) (string, error) {
 	trySpec := [2]string{}
 
-	if opts.listenEnv != "" {
-		val, ok := os.LookupEnv(opts.listenEnv)
+	if envName != "" {
+		val, ok := os.LookupEnv(envName)
 		if !ok {
-			return "", fmt.Errorf("told to use env $%s for port spec but not found in env", opts.listenEnv)
+			return "", fmt.Errorf("told to use env $%s for port spec but not found in env", envName)
 		}
 		trySpec[0] = val
 		trySpec[1] = ":" + val
 	} else {
-		trySpec[0] = opts.listen
-		trySpec[1] = ":" + opts.listen
+		trySpec[0] = spec
+		trySpec[1] = ":" + spec
 	}
 
 	for _, candidate := range trySpec {
@@ -150,7 +204,7 @@ func deriveListenPort() (string, error) {
 // GoServeThenClose wraps the start-up of a listener; this handles spawning the
 // go-routine; do not also wrap this in a go-routine other than the one which
 // later listens on the active waitgroup.
-func (fl *TCPFingerListener) GoServeThenClose() {
+func (fl *FingerListener) GoServeThenClose() {
 	fl.active.Add(2)
 	fl.Info("listening")
 	go fl.serveThenClose()
@@ -158,16 +212,18 @@ func (fl *TCPFingerListener) GoServeThenClose() {
 }
 
 // When told to shut down, cause the listen() to return.
-func (fl *TCPFingerListener) terminateOnShuttingDown() {
+func (fl *FingerListener) terminateOnShuttingDown() {
 	defer fl.active.Done()
 	// Waits almost the lifetime of the process:
 	<-fl.shuttingDown
-	fl.tcpListener.SetDeadline(aLongTimeAgo)
+	fl.listener.SetDeadline(aLongTimeAgo)
 }
 
-func (fl *TCPFingerListener) serveThenClose() {
+func (fl *FingerListener) serveThenClose() {
+	healthListenerServing(1)
 	defer func() {
-		if err := fl.tcpListener.Close(); err != nil {
+		healthListenerServing(-1)
+		if err := fl.listener.Close(); err != nil {
 			fl.WithError(err).Error("when closing listening socket")
 		} else {
 			fl.Info("closed listening socket")
@@ -178,7 +234,7 @@ func (fl *TCPFingerListener) serveThenClose() {
 	// We never change this until the end when it indicates shutdown; a zero
 	// value means no deadline.  This _should_ be the default but since we're
 	// using this as a control mechanism, be explicit.
-	fl.tcpListener.SetDeadline(time.Time{})
+	fl.listener.SetDeadline(time.Time{})
 
 LOOP:
 	for {
@@ -188,7 +244,7 @@ LOOP:
 		default:
 		}
 
-		conn, err := fl.tcpListener.AcceptTCP()
+		conn, err := fl.listener.Accept()
 		acceptedAt := time.Now()
 
 		if err != nil {
@@ -200,12 +256,39 @@ LOOP:
 			fl.WithError(err).Error("accepting connection")
 			continue
 		}
+		metricConnectionsAccepted.WithLabelValues(fl.networkFamily, fl.mode).Inc()
+
+		// For a trusted proxy, we check the client named in the PROXY header
+		// instead, in handleOneConnection.
+		if ok, rule := checkClientACL(conn.RemoteAddr()); !ok && !proxyHeaderExpected(conn.RemoteAddr()) {
+			// no response at all, not even a polite one
+			_ = conn.Close()
+			metricConnectionsRejected.WithLabelValues("acl").Inc()
+			fl.WithFields(logrus.Fields{
+				"local":  conn.LocalAddr(),
+				"remote": conn.RemoteAddr(),
+				"rule":   rule,
+			}).Info("client denied by ACL, closed")
+			continue
+		}
+
+		// A trusted proxy's clients are held to the per-IP limit once its
+		// header names them, not all together as the proxy's own.
+		limitPeer := conn.RemoteAddr()
+		if proxyHeaderExpected(limitPeer) {
+			limitPeer = nil
+		}
+		if ok, reason := connLimits.acquire(limitPeer); !ok {
+			metricConnectionsRejected.WithLabelValues("limit").Inc()
+			fl.rejectConnection(conn, reason)
+			continue
+		}
 
 		// nb: LocalAddr/RemoteAddr are cached attributes, not dynamically
 		// retrieved via syscalls (although I don't think that's guaranteed);
 		// thus they won't fail if the remote side has immediately disconnected
 		// and we don't need to worry about panics or errors when using them.
-		c := &TCPFingerConnection{
+		c := &FingerConnection{
 			// not sure that Entry is go-routine-safe, so spawn a new Entry
 			// from the Logger for each go-routine
 			Entry: fl.Entry.Logger.WithFields(logrus.Fields{
@@ -213,39 +296,119 @@ LOOP:
 				"remote":      conn.RemoteAddr(),
 				"accept-time": acceptedAt,
 			}),
-			l:    fl,
-			conn: conn,
+			l:          fl,
+			conn:       conn,
+			remote:     conn.RemoteAddr(),
+			limitPeer:  limitPeer,
+			acceptedAt: acceptedAt,
+			cfg:        currentSettings(),
+		}
+		if fields := peerCredentials(conn); fields != nil {
+			c.Entry = c.WithFields(fields)
 		}
+		inFlight.add(c, conn)
 		fl.active.Add(1)
 		go c.handleOneConnection()
 	}
 }
 
-func (c *TCPFingerConnection) handleOneConnection() {
+func (c *FingerConnection) handleOneConnection() {
 	var written int64
 
 	defer func() {
 		err := c.conn.Close()
-		if err != nil {
+		switch {
+		case c.cutOff.Load():
+			c.Info("connection cut off by shutdown")
+		case err != nil:
 			c.WithError(err).Error("error when closing connection")
 		}
+		inFlight.remove(c)
 		c.WithField("written", written).Info("connection closed")
+		metricBytesWritten.Add(float64(written))
+		metricConnectionDuration.Observe(time.Since(c.acceptedAt).Seconds())
+		connLimits.release(c.limitPeer)
 		c.l.active.Done()
 	}()
 
 	c.Debug("accepted connection")
+	if cfg := c.cfg.forLocalAddr(c.conn.LocalAddr()); cfg != c.cfg {
+		c.cfg = cfg
+		c.Entry = c.WithField("namespace", cfg.namespace)
+	}
 	// log-levels: nothing a remote person does warrants an error-level on our
 	// part; we don't need to spam level-filtered logs with people being idiots
 	// on the Internet.  So we log, with errors, but at Info level max.
 
-	c.conn.SetReadDeadline(time.Now().Add(opts.requestReadTimeout))
+	c.conn.SetReadDeadline(time.Now().Add(c.cfg.requestReadTimeout))
 
+	// The PROXY header comes first, before any TLS, and doesn't count towards
+	// the request size limit; it has its own.
+	if proxyHeaderExpected(c.remote) {
+		br := bufio.NewReaderSize(c.conn, proxyV2HeadLen+proxyV2MaxPayload)
+		clientAddr, err := readProxyHeader(br)
+		if err != nil {
+			c.WithError(err).Info("error reading PROXY header, aborting")
+			noteIOError("read", err)
+			return
+		}
+		c.conn = &bufferedConn{Conn: c.conn, r: br}
+		if clientAddr != nil {
+			c.Entry = c.WithFields(logrus.Fields{
+				"remote": clientAddr,
+				"proxy":  c.remote,
+			})
+			c.remote = clientAddr
+			if ok, rule := checkClientACL(c.remote); !ok {
+				c.WithField("rule", rule).Info("client denied by ACL, closing")
+				metricConnectionsRejected.WithLabelValues("acl").Inc()
+				return
+			}
+		}
+		// nil unless the proxy settings changed since accept, when the
+		// proxy itself already holds the slot
+		if c.limitPeer == nil {
+			if ok, reason := connLimits.acquirePerIP(c.remote); !ok {
+				metricConnectionsRejected.WithLabelValues("limit").Inc()
+				c.rejectOverLimit(reason)
+				return
+			}
+			c.limitPeer = c.remote
+		}
+	}
+
+	if c.l.tlsConfig != nil {
+		tc := tls.Server(c.conn, c.l.tlsConfig)
+		c.conn = tc
+		c.Entry = c.WithField("tls", true)
+		// The handshake both reads and writes; bound the writes too, with
+		// the same timeout.  sendLine/sendFile set their own write deadlines.
+		c.conn.SetWriteDeadline(time.Now().Add(c.cfg.requestReadTimeout))
+		if err := tc.Handshake(); err != nil {
+			c.WithError(err).Info("TLS handshake failed, aborting")
+			noteIOError("read", err)
+			return
+		}
+		state := tc.ConnectionState()
+		c.Entry = c.WithFields(logrus.Fields{
+			"tls-version": tls.VersionName(state.Version),
+			"tls-cipher":  tls.CipherSuiteName(state.CipherSuite),
+		})
+	}
+
+	written = c.serveRequest()
+}
+
+// serveRequest reads the finger request and writes the response; it's the
+// part of handling a connection which is about finger, not the network.
+func (c *FingerConnection) serveRequest() (written int64) {
 	// Usually "one userid", with optional prefix, but can have a white-space separated list.
 	// Let's limit to 500 octets.
 	r := bufio.NewReaderSize(io.LimitReader(c.conn, 500), 501)
 	input, err := r.ReadString('\n')
 	if err != nil && err != io.EOF {
 		c.WithError(err).Info("error reading request, aborting")
+		noteIOError("read", err)
 		return
 	}
 	l := len(input)
@@ -261,6 +424,7 @@ func (c *TCPFingerConnection) handleOneConnection() {
 
 	if l == 1 || l == 2 && input[0] == '\r' {
 		c.Info("request to list local users, denying")
+		metricRequests.WithLabelValues(outcomeListDenied).Inc()
 		written += c.sendLine("Local user listing denied.")
 		return
 	}
@@ -297,11 +461,20 @@ func (c *TCPFingerConnection) handleOneConnection() {
 
 		c.username = user
 		c.uid = 0
+		c.anyOwner = false
 		c.Entry = baseLog.WithField("username", user)
-		// The Dispatch!
-		written += c.processUser()
+		if lookupLimits.allow(c.remote) {
+			// The Dispatch!
+			written += c.processUser()
+		} else {
+			// same response as unknown, so as not to confirm anything to a scraper
+			c.Info("lookup rate limit exceeded, pretending unknown user")
+			metricRequests.WithLabelValues(outcomeRateLimited).Inc()
+			written += c.sendLine(noSuchUserText(user))
+		}
 		c.Entry = baseLog
 		c.uid = 0
+		c.anyOwner = false
 		c.homeDir = ""
 		c.username = ""
 
@@ -314,6 +487,7 @@ func (c *TCPFingerConnection) handleOneConnection() {
 	if !seen {
 		if c.long {
 			c.Info("request to LONG list local users, denying")
+			metricRequests.WithLabelValues(outcomeListDenied).Inc()
 			written += c.sendLine("Local user long listing denied.")
 			return
 		}
@@ -321,4 +495,5 @@ func (c *TCPFingerConnection) handleOneConnection() {
 		// still not rewarding hinkiness with attempts to write a response
 		return
 	}
+	return
 }
@@ -0,0 +1,57 @@
+// Copyright © 2020 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// testConnection gives a connection with request waiting to be read, and
+// settings which find nobody unless the test sets them up.
+func testConnection(t *testing.T, request string) (*FingerConnection, *memConn) {
+	t.Helper()
+	logger := logrus.New()
+	logger.Out = io.Discard
+	cfg := *currentSettings()
+	cfg.aliasFile = ""
+	cfg.homesDir = t.TempDir()
+	cfg.minPasswdUID = 0
+	conn := &memConn{request: strings.NewReader(request)}
+	return &FingerConnection{
+		Entry:      logrus.NewEntry(logger),
+		conn:       conn,
+		remote:     conn.RemoteAddr(),
+		acceptedAt: time.Now(),
+		cfg:        &cfg,
+	}, conn
+}
+
+func TestServeRequestSizeBound(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		request string
+		replied bool
+	}{
+		{"short", "nobody\r\n", true},
+		{"exactly 500 octets", strings.Repeat("x", 498) + "\r\n", true},
+		{"501 octets", strings.Repeat("x", 499) + "\r\n", false},
+		{"no newline", strings.Repeat("x", 600), false},
+		{"unterminated", "alice", false},
+		{"empty", "", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c, conn := testConnection(t, tc.request)
+			c.serveRequest()
+			if got := conn.response.Len() > 0; got != tc.replied {
+				t.Fatalf("replied=%v, want %v: %q", got, tc.replied, conn.response.String())
+			}
+		})
+	}
+}
@@ -16,7 +16,6 @@ import (
 )
 
 var logOpts struct {
-	level        string
 	json         bool
 	syslogRemote string
 	syslogProto  string
@@ -25,7 +24,6 @@ var logOpts struct {
 }
 
 func init() {
-	flag.StringVar(&logOpts.level, "log.level", "info", "logging level (\"help\" to list)")
 	flag.BoolVar(&logOpts.json, "log.json", false, "format logs into JSON")
 	flag.BoolVar(&logOpts.noLocal, "log.no-local", false, "inhibit stdio logging, only use any log hooks (syslog)")
 	flag.StringVar(&logOpts.syslogRemote, "log.syslog.address", "", "host:port to send logs to via syslog")
@@ -63,14 +61,14 @@ func setupLogging() *logrus.Logger {
 		l.Formatter = &logrus.JSONFormatter{}
 	}
 
-	if logOpts.level == "" || logOpts.level == "help" {
+	if startupSettings.logLevel == "" || startupSettings.logLevel == "help" {
 		l.Infof("Available logging levels: %v", logrus.AllLevels)
 		os.Exit(0)
 	}
-	lvl, err := logrus.ParseLevel(logOpts.level)
+	lvl, err := logrus.ParseLevel(startupSettings.logLevel)
 	if err != nil {
 		time.Sleep(time.Second)
-		l.Fatalf("unable to parse logging level %q", logOpts.level)
+		l.Fatalf("unable to parse logging level %q", startupSettings.logLevel)
 	}
 	l.SetLevel(lvl)
 
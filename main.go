@@ -32,30 +32,27 @@ import (
 const defaultFileSizeLimit = 256 * 1024
 
 var opts struct {
-	aliasfile           string
-	listen              string
-	listenEnv           string
-	homesDir            string
-	runAsUser           string
-	pidFile             string
-	fileSizeLimit       int64
-	requestReadTimeout  time.Duration
-	requestWriteTimeout time.Duration
-	minPasswdUID        uint64
-	showVersion         bool
+	configFile  string
+	listen      string
+	listenEnv   string
+	runAsUser   string
+	pidFile     string
+	showVersion bool
+	printConfig bool
 }
 
+// subcommands are alternative modes of the binary, selected by the first
+// non-flag argument; they're registered by init functions, are given the
+// remaining arguments and return the exit code.  Flags for the daemon still
+// apply, so that eg `fingerd -listen-env=PORT healthcheck` probes the same
+// port as `fingerd -listen-env=PORT` serves.
+var subcommands = map[string]func(args []string) int{}
+
 func init() {
-	flag.StringVar(&opts.aliasfile, "alias-file", "/etc/finger.conf", "file to read aliases from (if it exists)")
-	flag.StringVar(&opts.homesDir, "homes-dir", "/home", "where end-user home-dirs live")
 	flag.StringVar(&opts.listen, "listen", ":79", "address-spec to listen for finger requests on")
 	flag.StringVar(&opts.listenEnv, "listen-env", "", "environment variable to use as -listen (takes precedence)")
 	flag.StringVar(&opts.runAsUser, "run-as-user", "", "if starting as root, setuid to this user")
 	flag.StringVar(&opts.pidFile, "pidfile", "", "write pid to this file after bind but before listening")
-	flag.DurationVar(&opts.requestReadTimeout, "request.timeout.read", 10*time.Second, "timeout for receiving the finger request")
-	flag.DurationVar(&opts.requestWriteTimeout, "request.timeout.write", 30*time.Second, "timeout for each write of the response")
-	flag.Int64Var(&opts.fileSizeLimit, "file.size-limit", defaultFileSizeLimit, "how large a file we will serve")
-	flag.Uint64Var(&opts.minPasswdUID, "passwd.min-uid", 0, "set non-zero to enable passwd lookups")
 	flag.BoolVar(&opts.showVersion, "version", false, "show version and exit")
 
 	// TODO: remove this in a future release
@@ -65,13 +62,33 @@ func init() {
 
 func main() {
 	flag.Parse()
-
+	// A broken config file shouldn't stop us saying what version we are.
 	if opts.showVersion {
 		version()
 		return
 	}
 
-	// q: should this really be one global waitgroup instead of per-AF and entirely encapsulate in the TCPFingerListener?
+	recordCommandLineFlags()
+	if err := applyStartupConfig(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", fingerProgram, err)
+		os.Exit(2)
+	}
+
+	if opts.printConfig {
+		printConfig(os.Stdout)
+		return
+	}
+
+	if flag.NArg() > 0 {
+		sub, ok := subcommands[flag.Arg(0)]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "%s: unknown subcommand %q\n", fingerProgram, flag.Arg(0))
+			os.Exit(2)
+		}
+		os.Exit(sub(flag.Args()[1:]))
+	}
+
+	// q: should this really be one global waitgroup instead of per-AF and entirely encapsulate in the FingerListener?
 	running := &sync.WaitGroup{}
 	running.Add(1)
 	shutdown := make(chan struct{})
@@ -88,22 +105,54 @@ func main() {
 		"go":      goVersion(),
 	})
 
-	haveListeners := make([]*TCPFingerListener, 0, 3)
+	// The config file may override the log level, so setupLogging used the
+	// command-line value; check the combination before we do anything else.
+	if cfg, err := buildSettings(); err != nil {
+		time.Sleep(time.Second)
+		fullStatusLogger.WithError(err).WithField("config", opts.configFile).Fatal("bad configuration")
+	} else {
+		liveSettings.Store(cfg)
+		lvl, _ := logrus.ParseLevel(cfg.logLevel) // validated
+		logger.SetLevel(lvl)
+	}
+
+	haveListeners := make([]*FingerListener, 0, 3)
 
 	if tmp, ok := inheritedListeners(running, shutdown, logger); ok {
 		masterThreadLogger.Infof("recovered %d listeners", len(tmp))
 		haveListeners = tmp
+	} else if tmp, ok := systemdListeners(running, shutdown, logger); ok {
+		masterThreadLogger.Infof("received %d listeners from systemd", len(tmp))
+		haveListeners = tmp
 	} else {
-		for _, netFamily := range []string{"tcp4", "tcp6"} {
-			fl, err := NewTCPFingerListener(netFamily, running, shutdown, logger)
+		// An empty -listen (without -listen-env) is for unix-socket-only setups.
+		modes := make([]string, 0, 2)
+		if opts.listen != "" || opts.listenEnv != "" {
+			modes = append(modes, listenModePlain)
+		}
+		if tlsOpts.listen != "" {
+			modes = append(modes, listenModeTLS)
+		}
+		for _, mode := range modes {
+			for _, netFamily := range []string{"tcp4", "tcp6"} {
+				fl, err := NewFingerListener(netFamily, mode, running, shutdown, logger)
+				if err != nil {
+					// It's not an error to fail to listen on just one family (eg,
+					// system which is missing IPv4) so only Warn level.  If we got
+					// none at all, then we'll fatal out below, which will cover us.
+					masterThreadLogger.WithError(err).Warnf("failed to listen/%s/%s", netFamily, mode)
+				} else {
+					haveListeners = append(haveListeners, fl)
+					// start below, after dropping privs and loading aliases
+				}
+			}
+		}
+		if unixOpts.path != "" {
+			fl, err := NewUnixFingerListener(running, shutdown, logger)
 			if err != nil {
-				// It's not an error to fail to listen on just one family (eg,
-				// system which is missing IPv4) so only Warn level.  If we got
-				// none at all, then we'll fatal out below, which will cover us.
-				masterThreadLogger.WithError(err).Warnf("failed to listen/%s", netFamily)
+				masterThreadLogger.WithError(err).WithField("path", unixOpts.path).Warn("failed to listen/unix")
 			} else {
 				haveListeners = append(haveListeners, fl)
-				// start below, after dropping privs and loading aliases
 			}
 		}
 	}
@@ -128,19 +177,68 @@ func main() {
 	// to the channel, so it MUST be buffered.  [caught by staticcheck]
 	signalShutdownCh := make(chan os.Signal, 1)
 	signal.Notify(signalShutdownCh, syscall.SIGTERM, syscall.SIGINT)
+	signalUpgradeCh := make(chan os.Signal, 1)
+	signal.Notify(signalUpgradeCh, syscall.SIGUSR2)
+	signalReloadCh := make(chan os.Signal, 1)
+	signal.Notify(signalReloadCh, syscall.SIGHUP)
 
 	// We parse these _after_ dropping privileges, so the listening socket is open, but
 	// before we start the listening, so that the aliases are available without race.
-	if opts.aliasfile != "" {
-		// It's okay for the file to not exist.  Also, if it doesn't exist but later comes into existence,
-		// we accept it at that point.  A _missing_ file should not immediately blank data (might be a race
-		// between updates in a bad editor) so write an empty file first, before deleting it, if you want that.
-		//
-		// Because it's okay to not exist, we never actually fail setup and abort service.  If we lose
-		// the ability to dynamically reload then that will be logged.  It's thus in the audit trail and
-		// an acceptable degradation of service.
-		loadMappingData(logger)
-		scheduleAutoMappingDataReload(logger)
+	//
+	// It's okay for the files to not exist.  Also, if one doesn't exist but later comes into existence,
+	// we accept it at that point.  A _missing_ file should not immediately blank data (might be a race
+	// between updates in a bad editor) so write an empty file first, before deleting it, if you want that.
+	//
+	// Because it's okay to not exist, we never actually fail setup and abort service.  If we lose
+	// the ability to dynamically reload then that will be logged.  It's thus in the audit trail and
+	// an acceptable degradation of service.
+	syncAliasFiles(logger, true)
+
+	if (passwdIndexWanted() || showOpts.realName) && currentSettings().minPasswdUID == 0 {
+		masterThreadLogger.Warn("GECOS lookup and display have no effect while -passwd.min-uid is 0")
+	}
+	if passwdIndexWanted() {
+		startPasswdIndex(logger)
+	}
+	if err := setupLDAP(); err != nil {
+		time.Sleep(time.Second)
+		fullStatusLogger.WithError(err).Fatal("bad LDAP configuration")
+	}
+	if err := checkForwardOpts(); err != nil {
+		time.Sleep(time.Second)
+		fullStatusLogger.WithError(err).Fatal("bad forwarding configuration")
+	}
+
+	// Likewise the client ACLs; these do fail closed if missing, but that's
+	// handled in checking, so as to pick up a late-created allow-list.
+	if aclOpts.allowFile != "" {
+		loadAllowList(logger)
+	}
+	if aclOpts.denyFile != "" {
+		loadDenyList(logger)
+	}
+	scheduleAutoACLReload(logger)
+
+	// Likewise the TLS certificate; unlike the aliases, we can't usefully
+	// serve TLS without one, so that is fatal.
+	for _, fl := range haveListeners {
+		if fl.mode != listenModeTLS {
+			continue
+		}
+		if tlsOpts.certFile == "" || tlsOpts.keyFile == "" {
+			time.Sleep(time.Second)
+			fullStatusLogger.Fatal("TLS listener needs both -tls.cert and -tls.key")
+		}
+		if !loadTLSCertificate(logger) {
+			time.Sleep(time.Second)
+			fullStatusLogger.Fatal("TLS listener present but no TLS certificate loaded")
+		}
+		scheduleAutoTLSReload(logger)
+		break
+	}
+
+	if httpOpts.listen != "" {
+		startHTTPServer(logger)
 	}
 
 	// Pidfile must be after bind, but before listening.
@@ -160,6 +258,7 @@ func main() {
 	go childReaper(logger)
 
 	// From this point on, we're accepting connection.
+	healthSetListenersExpected(len(haveListeners))
 	for _, fl := range haveListeners {
 		fl.GoServeThenClose()
 	}
@@ -168,13 +267,65 @@ func main() {
 		"listeners": len(haveListeners),
 	}).Info("running")
 
+	// If we're the new process in a live upgrade, the old one can go now.
+	signalUpgradeReady(masterThreadLogger)
+
+	// An upgrade waits for the new process in the background, reporting here.
+	type upgradeResult struct {
+		pid int
+		err error
+	}
+	upgradeDone := make(chan upgradeResult, 1)
+	upgrading := false
+
 	// Hang around forever, or until signalled
-	masterThreadLogger.WithField("signal", <-signalShutdownCh).Warn("shutdown signal received")
+	handedOff := false
+WAIT:
+	for {
+		select {
+		case sig := <-signalShutdownCh:
+			if upgrading {
+				masterThreadLogger.WithField("signal", sig).Warn("shutdown signal received, abandoning upgrade")
+			} else {
+				masterThreadLogger.WithField("signal", sig).Warn("shutdown signal received")
+			}
+			break WAIT
+		case sig := <-signalReloadCh:
+			masterThreadLogger.WithField("signal", sig).Info("reload signal received")
+			reloadSettings(logger, masterThreadLogger)
+		case sig := <-signalUpgradeCh:
+			if upgrading {
+				masterThreadLogger.WithField("signal", sig).Warn("upgrade signal received while upgrading, ignored")
+				continue
+			}
+			masterThreadLogger.WithField("signal", sig).Warn("upgrade signal received")
+			upgrading = true
+			upgradeLog := masterThreadLogger.WithField("upgrade", true)
+			go func() {
+				pid, err := upgradeBinary(haveListeners, shutdown, upgradeLog)
+				upgradeDone <- upgradeResult{pid: pid, err: err}
+			}()
+		case result := <-upgradeDone:
+			upgrading = false
+			if result.err != nil {
+				masterThreadLogger.WithError(result.err).Error("upgrade failed, continuing to serve")
+				continue
+			}
+			masterThreadLogger.WithField("new-pid", result.pid).Warn("new process serving, handing over")
+			for _, fl := range haveListeners {
+				fl.keepSocketFile()
+			}
+			handedOff = true
+			break WAIT
+		}
+	}
+	healthSetShuttingDown()
 
 	close(shutdown)
-	running.Wait()
+	drainConnections(running, masterThreadLogger)
 
-	if weCreatedPidfile {
+	// The new process has overwritten the pidfile with its own pid
+	if weCreatedPidfile && !handedOff {
 		_ = os.Remove(opts.pidFile)
 	}
 
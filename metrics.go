@@ -0,0 +1,95 @@
+// Copyright © 2020 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package main
+
+import (
+	"errors"
+	"net"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "fingerd"
+
+// Request outcomes, for the "outcome" label; these are per user looked up,
+// except for the listing denials which are per connection.
+const (
+	outcomeServed        = "served"
+	outcomeStaticFile    = "static_file"
+	outcomeUnknownUser   = "unknown_user"
+	outcomeNoFinger      = "nofinger"
+	outcomeMissingFiles  = "missing_files"
+	outcomeRateLimited   = "rate_limited"
+	outcomeListDenied    = "list_users_denied"
+	outcomeForwarded     = "forwarded"
+	outcomeForwardDenied = "forward_denied"
+	outcomeForwardFailed = "forward_failed"
+)
+
+var (
+	metricConnectionsAccepted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "connections_accepted_total",
+		Help:      "Connections accepted, per listener family and mode.",
+	}, []string{"family", "mode"})
+	metricConnectionsRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "connections_rejected_total",
+		Help:      "Connections closed without service, by reason.",
+	}, []string{"reason"})
+	metricConnectionDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "connection_duration_seconds",
+		Help:      "Time from accepting a connection to closing it.",
+		Buckets:   []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60},
+	})
+	metricRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "requests_total",
+		Help:      "Finger requests by outcome; one per user asked for.",
+	}, []string{"outcome"})
+	metricBytesWritten = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "response_bytes_total",
+		Help:      "Octets written to clients.",
+	})
+	metricTimeouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "timeouts_total",
+		Help:      "Client I/O which hit a deadline, by direction.",
+	}, []string{"direction"})
+	metricAliasReloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "alias_loads_total",
+		Help:      "Attempts to load the alias file, by result.",
+	}, []string{"result"})
+	metricAliasCount = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "aliases",
+		Help:      "Aliases currently loaded.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		metricConnectionsAccepted,
+		metricConnectionsRejected,
+		metricConnectionDuration,
+		metricRequests,
+		metricBytesWritten,
+		metricTimeouts,
+		metricAliasReloads,
+		metricAliasCount,
+	)
+}
+
+// noteIOError counts the error if it was a deadline being hit; direction is
+// "read" or "write".
+func noteIOError(direction string, err error) {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		metricTimeouts.WithLabelValues(direction).Inc()
+	}
+}
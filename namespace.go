@@ -0,0 +1,198 @@
+// Copyright © 2020 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"strings"
+)
+
+// Namespaces are for hosting finger for several domains on one machine: a
+// connection to one of a namespace's local addresses gets that namespace's
+// users.  They're only in the config file, as tables:
+//
+//	[namespace.example-org]
+//	addresses = ["192.0.2.10", "[2001:db8::10]:79"]
+//	alias-file = "/etc/finger.d/example.org.conf"
+//	homes-dir = ""
+//	virtual-home = ["/srv/finger/example.org:fingeradm"]
+//
+// A namespace starts from the top-level settings and overrides only the
+// user-lookup settings in namespaceKeys; being more specific, they win even
+// over the command-line.  An address without a port matches any port.
+// Connections to other addresses, and over unix-domain sockets, get the
+// top-level settings.  Namespaces are re-read on SIGHUP, like the settings.
+
+const (
+	namespaceTable        = "namespace"
+	namespaceAddressesKey = "addresses"
+)
+
+var namespaceKeys = map[string]bool{
+	"alias-file":     true,
+	"homes-dir":      true,
+	"passwd.min-uid": true,
+	"resolvers":      true,
+	"virtual-home":   true,
+}
+
+type namespace struct {
+	name  string
+	addrs []netip.AddrPort // port 0 for any
+	cfg   *settings
+}
+
+func parseNamespaceAddress(s string) (netip.AddrPort, error) {
+	if ap, err := netip.ParseAddrPort(s); err == nil {
+		return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port()), nil
+	}
+	a, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("address %q: want IP or IP:port", s)
+	}
+	return netip.AddrPortFrom(a.Unmap(), 0), nil
+}
+
+// buildNamespace applies the namespace's values over a copy of base.
+func buildNamespace(base *settings, name string, values map[string][]string) (namespace, error) {
+	ns := namespace{name: name}
+	for _, a := range values[namespaceAddressesKey] {
+		ap, err := parseNamespaceAddress(a)
+		if err != nil {
+			return namespace{}, fmt.Errorf("namespace %q: %w", name, err)
+		}
+		ns.addrs = append(ns.addrs, ap)
+	}
+	if len(ns.addrs) == 0 {
+		return namespace{}, fmt.Errorf("namespace %q: no %s", name, namespaceAddressesKey)
+	}
+
+	overrides := make(map[string][]string, len(values))
+	for k, v := range values {
+		if k == namespaceAddressesKey {
+			continue
+		}
+		if !namespaceKeys[k] {
+			return namespace{}, fmt.Errorf("namespace %q: key %q can't be set per namespace", name, k)
+		}
+		overrides[k] = v
+	}
+
+	cfg := &settings{}
+	fs := flag.NewFlagSet("namespace", flag.ContinueOnError)
+	registerSettingsFlags(fs, cfg) // sets defaults, so overwrite after
+	*cfg = *base
+	cfg.namespace = name
+	cfg.namespaces = nil
+	if err := applyConfigValues(fs, overrides, nil, ""); err != nil {
+		return namespace{}, fmt.Errorf("namespace %q: %w", name, err)
+	}
+	if err := cfg.validate(); err != nil {
+		return namespace{}, fmt.Errorf("namespace %q: %w", name, err)
+	}
+	ns.cfg = cfg
+	return ns, nil
+}
+
+// buildNamespaces sets base.namespaces, in name order.
+func buildNamespaces(base *settings, all map[string]map[string][]string) error {
+	names := make([]string, 0, len(all))
+	for name := range all {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	claimed := make(map[netip.AddrPort]string)
+	for _, name := range names {
+		ns, err := buildNamespace(base, name, all[name])
+		if err != nil {
+			return err
+		}
+		for _, ap := range ns.addrs {
+			if other, dup := claimed[ap]; dup {
+				return fmt.Errorf("namespaces %q and %q both claim %s", other, name, namespaceAddrString(ap))
+			}
+			claimed[ap] = name
+		}
+		base.namespaces = append(base.namespaces, ns)
+	}
+	return nil
+}
+
+func namespaceAddrString(ap netip.AddrPort) string {
+	if ap.Port() == 0 {
+		return ap.Addr().String()
+	}
+	return ap.String()
+}
+
+// forLocalAddr gives the settings for a connection to local; an exact port
+// match beats an any-port match.
+func (s *settings) forLocalAddr(local net.Addr) *settings {
+	ta, ok := local.(*net.TCPAddr)
+	if !ok || len(s.namespaces) == 0 {
+		return s
+	}
+	ap := ta.AddrPort()
+	ap = netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+	var anyPort *settings
+	for i := range s.namespaces {
+		for _, want := range s.namespaces[i].addrs {
+			switch {
+			case want == ap:
+				return s.namespaces[i].cfg
+			case want.Port() == 0 && want.Addr() == ap.Addr():
+				anyPort = s.namespaces[i].cfg
+			}
+		}
+	}
+	if anyPort != nil {
+		return anyPort
+	}
+	return s
+}
+
+// namespaceValues adds the namespaces to a values() map, for diffing.
+func (s *settings) namespaceValues(out map[string]string) {
+	for _, ns := range s.namespaces {
+		addrs := make([]string, len(ns.addrs))
+		for i := range ns.addrs {
+			addrs[i] = namespaceAddrString(ns.addrs[i])
+		}
+		prefix := "namespace." + ns.name + "."
+		out[prefix+namespaceAddressesKey] = strings.Join(addrs, ",")
+		for k, v := range ns.cfg.values() {
+			if namespaceKeys[k] {
+				out[prefix+k] = v
+			}
+		}
+	}
+}
+
+// aliasFiles gives each alias file in use, by the top-level settings or
+// any namespace.
+func (s *settings) aliasFiles() []string {
+	seen := make(map[string]bool)
+	var out []string
+	for _, f := range append([]string{s.aliasFile}, s.namespaceAliasFiles()...) {
+		if f != "" && !seen[f] {
+			seen[f] = true
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+func (s *settings) namespaceAliasFiles() []string {
+	out := make([]string, len(s.namespaces))
+	for i := range s.namespaces {
+		out[i] = s.namespaces[i].cfg.aliasFile
+	}
+	return out
+}
@@ -0,0 +1,44 @@
+// Copyright © 2020 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package main
+
+import (
+	"net"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+)
+
+// peerCredentials returns logging fields identifying the process at the other
+// end of a unix-domain socket, or nil if there's nothing to say.  This is
+// audit-trail only, we make no access decisions based upon it.
+func peerCredentials(conn net.Conn) logrus.Fields {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return logrus.Fields{"peer-cred-error": err.Error()}
+	}
+	var (
+		cred    *syscall.Ucred
+		credErr error
+	)
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err == nil {
+		err = credErr
+	}
+	if err != nil {
+		return logrus.Fields{"peer-cred-error": err.Error()}
+	}
+	return logrus.Fields{
+		"peer-pid": cred.Pid,
+		"peer-uid": cred.Uid,
+		"peer-gid": cred.Gid,
+	}
+}
@@ -0,0 +1,19 @@
+// Copyright © 2020 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+//go:build !linux
+
+package main
+
+import (
+	"net"
+
+	"github.com/sirupsen/logrus"
+)
+
+// peerCredentials would use LOCAL_PEERCRED/getpeereid on the BSDs; patches
+// welcome.  Until then, we log nothing extra.
+func peerCredentials(conn net.Conn) logrus.Fields {
+	return nil
+}
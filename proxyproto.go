@@ -0,0 +1,255 @@
+// Copyright © 2020 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// HAProxy's PROXY protocol, v1 (text) and v2 (binary), per
+// <https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt>
+//
+// We only look for a header from connections whose socket peer is trusted; a
+// trusted peer MUST send one (a LOCAL command is fine, for health-checks).
+// Anyone else gets treated as a direct client and any header they send will
+// just be a malformed request.
+
+var proxyOpts struct {
+	trusted cidrList
+	unix    bool
+}
+
+func init() {
+	flag.Var(&proxyOpts.trusted, "proxy-protocol.trusted", "comma-separated CIDRs of load-balancers whose PROXY headers we require and trust")
+	flag.BoolVar(&proxyOpts.unix, "proxy-protocol.unix", false, "require and trust PROXY headers on unix-domain socket connections")
+}
+
+const (
+	// "the maximum line lengths the receiver must support including the CRLF are 107"
+	proxyV1MaxLen  = 107
+	proxyV2HeadLen = 16
+	// The spec lets TLVs take this to 64KiB; we're not interested in TLVs and
+	// we're not going to buffer that much for someone else's extensions.
+	proxyV2MaxPayload = 1024
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var errProxyHeaderMalformed = errors.New("malformed PROXY header")
+
+// A cidrList is a flag.Value holding comma-separated network prefixes.
+type cidrList []netip.Prefix
+
+func (cl *cidrList) String() string {
+	if cl == nil {
+		return ""
+	}
+	s := make([]string, len(*cl))
+	for i := range *cl {
+		s[i] = (*cl)[i].String()
+	}
+	return strings.Join(s, ",")
+}
+
+func (cl *cidrList) Set(value string) error {
+	var out cidrList
+	for item := range strings.SplitSeq(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		p, err := parsePrefixOrAddr(item)
+		if err != nil {
+			return err
+		}
+		out = append(out, p)
+	}
+	*cl = out
+	return nil
+}
+
+func (cl *cidrList) SetList(values []string) error {
+	return cl.Set(strings.Join(values, ","))
+}
+
+func (cl *cidrList) List() []string {
+	s := make([]string, len(*cl))
+	for i := range *cl {
+		s[i] = (*cl)[i].String()
+	}
+	return s
+}
+
+// parsePrefixOrAddr accepts a bare address as a single-host prefix.
+func parsePrefixOrAddr(s string) (netip.Prefix, error) {
+	if strings.ContainsRune(s, '/') {
+		p, err := netip.ParsePrefix(s)
+		return p.Masked(), err
+	}
+	a, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(a, a.BitLen()), nil
+}
+
+func (cl cidrList) contains(a netip.Addr) bool {
+	a = a.Unmap()
+	for _, p := range cl {
+		if p.Contains(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// addrToNetip extracts the IP from a TCP peer address; ok is false for
+// anything else (unix-domain sockets).
+func addrToNetip(a net.Addr) (netip.Addr, bool) {
+	ta, ok := a.(*net.TCPAddr)
+	if !ok {
+		return netip.Addr{}, false
+	}
+	ip, ok := netip.AddrFromSlice(ta.IP)
+	return ip.Unmap(), ok
+}
+
+// proxyHeaderExpected says whether the socket peer must send us a header.
+func proxyHeaderExpected(peer net.Addr) bool {
+	if _, ok := peer.(*net.UnixAddr); ok {
+		return proxyOpts.unix
+	}
+	ip, ok := addrToNetip(peer)
+	return ok && proxyOpts.trusted.contains(ip)
+}
+
+// A bufferedConn lets us hand on whatever we read past the PROXY header, to
+// the TLS layer or the request reader.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (bc *bufferedConn) Read(b []byte) (int, error) {
+	return bc.r.Read(b)
+}
+
+// readProxyHeader returns the client address as stated by the proxy, or nil
+// if the proxy says to use the socket's addresses (health-checks, or it
+// doesn't know).  The caller is responsible for deadlines.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch first[0] {
+	case 'P':
+		return readProxyHeaderV1(r)
+	case proxyV2Signature[0]:
+		return readProxyHeaderV2(r)
+	}
+	return nil, fmt.Errorf("%w: no signature", errProxyHeaderMalformed)
+}
+
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, error) {
+	line := make([]byte, 0, proxyV1MaxLen)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= proxyV1MaxLen {
+			return nil, fmt.Errorf("%w: v1 line too long", errProxyHeaderMalformed)
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("%w: v1 line not CRLF terminated", errProxyHeaderMalformed)
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, fmt.Errorf("%w: v1 bad preamble", errProxyHeaderMalformed)
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, fmt.Errorf("%w: v1 unknown protocol %q", errProxyHeaderMalformed, fields[1])
+	}
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("%w: v1 wrong field count", errProxyHeaderMalformed)
+	}
+	src, err := netip.ParseAddr(fields[2])
+	if err != nil || src.Is4() != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("%w: v1 bad source address", errProxyHeaderMalformed)
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("%w: v1 bad source port", errProxyHeaderMalformed)
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(src, uint16(port))), nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	head := make([]byte, proxyV2HeadLen)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(head[:12], proxyV2Signature) {
+		return nil, fmt.Errorf("%w: v2 bad signature", errProxyHeaderMalformed)
+	}
+	if head[12]>>4 != 2 {
+		return nil, fmt.Errorf("%w: v2 unknown version %d", errProxyHeaderMalformed, head[12]>>4)
+	}
+	command := head[12] & 0x0F
+	family := head[13] >> 4
+	payloadLen := int(binary.BigEndian.Uint16(head[14:16]))
+	if payloadLen > proxyV2MaxPayload {
+		return nil, fmt.Errorf("%w: v2 payload too long (%d)", errProxyHeaderMalformed, payloadLen)
+	}
+	payload := make([]byte, payloadLen)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	switch command {
+	case 0x0: // LOCAL
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("%w: v2 unknown command %d", errProxyHeaderMalformed, command)
+	}
+
+	var addrLen int
+	switch family {
+	case 0x1: // AF_INET
+		addrLen = 4
+	case 0x2: // AF_INET6
+		addrLen = 16
+	default:
+		// AF_UNSPEC, AF_UNIX: nothing useful for us
+		return nil, nil
+	}
+	if len(payload) < 2*addrLen+4 {
+		return nil, fmt.Errorf("%w: v2 address block too short", errProxyHeaderMalformed)
+	}
+	src, _ := netip.AddrFromSlice(payload[:addrLen])
+	port := binary.BigEndian.Uint16(payload[2*addrLen : 2*addrLen+2])
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(src, port)), nil
+}
@@ -0,0 +1,175 @@
+// Copyright © 2020 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// proxyV2 builds a v2 header; addrs is the address block as sent.
+func proxyV2(command, family byte, addrs []byte) []byte {
+	h := append([]byte(nil), proxyV2Signature...)
+	h = append(h, 0x20|command, family<<4|0x1)
+	h = binary.BigEndian.AppendUint16(h, uint16(len(addrs)))
+	return append(h, addrs...)
+}
+
+func v2IPv4Block(src, dst [4]byte, sport, dport uint16) []byte {
+	b := append(src[:], dst[:]...)
+	b = binary.BigEndian.AppendUint16(b, sport)
+	return binary.BigEndian.AppendUint16(b, dport)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v6src := net.ParseIP("2001:db8::1").To16()
+	v6dst := net.ParseIP("2001:db8::2").To16()
+	v6block := append(append(append([]byte(nil), v6src...), v6dst...), 0x30, 0x39, 0x00, 0x4f)
+
+	for _, tc := range []struct {
+		name      string
+		input     string
+		want      string // "" for nil address
+		malformed bool   // else any error is wanted if wantErr
+		wantErr   bool
+		rest      string // what must be left for the request reader
+	}{
+		{name: "v1 tcp4", input: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 79\r\nalice\r\n", want: "192.0.2.1:56324", rest: "alice\r\n"},
+		{name: "v1 tcp6", input: "PROXY TCP6 2001:db8::1 2001:db8::2 12345 79\r\n", want: "[2001:db8::1]:12345"},
+		{name: "v1 unknown", input: "PROXY UNKNOWN\r\nbob\r\n", rest: "bob\r\n"},
+		{name: "v1 unknown with addresses", input: "PROXY UNKNOWN 192.0.2.1 198.51.100.1 1 2\r\n"},
+		{name: "v1 family mismatch", input: "PROXY TCP4 2001:db8::1 2001:db8::2 1 79\r\n", malformed: true},
+		{name: "v1 bad port", input: "PROXY TCP4 192.0.2.1 198.51.100.1 65536 79\r\n", malformed: true},
+		{name: "v1 bad protocol", input: "PROXY UDP4 192.0.2.1 198.51.100.1 1 79\r\n", malformed: true},
+		{name: "v1 field count", input: "PROXY TCP4 192.0.2.1 198.51.100.1 1\r\n", malformed: true},
+		{name: "v1 bare LF", input: "PROXY UNKNOWN\n", malformed: true},
+		{name: "v1 bad preamble", input: "PROXYZ TCP4 192.0.2.1 198.51.100.1 1 79\r\n", malformed: true},
+		{name: "v1 oversized", input: "PROXY TCP4 " + strings.Repeat("1", proxyV1MaxLen) + "\r\n", malformed: true},
+		{name: "v1 truncated", input: "PROXY TCP4 192.0.2.1", wantErr: true},
+		{name: "no signature", input: "alice\r\n", malformed: true},
+		{name: "empty", input: "", wantErr: true},
+
+		{name: "v2 tcp4", input: string(proxyV2(0x1, 0x1, v2IPv4Block([4]byte{192, 0, 2, 7}, [4]byte{198, 51, 100, 1}, 40000, 79))) + "carol\r\n", want: "192.0.2.7:40000", rest: "carol\r\n"},
+		{name: "v2 tcp6", input: string(proxyV2(0x1, 0x2, v6block)), want: "[2001:db8::1]:12345"},
+		{name: "v2 tcp4 with TLVs", input: string(proxyV2(0x1, 0x1, append(v2IPv4Block([4]byte{192, 0, 2, 8}, [4]byte{198, 51, 100, 1}, 1, 79), 0x04, 0x00, 0x01, 0xff))), want: "192.0.2.8:1"},
+		{name: "v2 local", input: string(proxyV2(0x0, 0x0, nil)) + "dave\r\n", rest: "dave\r\n"},
+		{name: "v2 local ignores addresses", input: string(proxyV2(0x0, 0x1, v2IPv4Block([4]byte{192, 0, 2, 9}, [4]byte{198, 51, 100, 1}, 1, 79)))},
+		{name: "v2 unspec", input: string(proxyV2(0x1, 0x0, nil))},
+		{name: "v2 unix", input: string(proxyV2(0x1, 0x3, make([]byte, 216)))},
+		{name: "v2 unknown command", input: string(proxyV2(0x2, 0x1, v2IPv4Block([4]byte{192, 0, 2, 1}, [4]byte{198, 51, 100, 1}, 1, 79))), malformed: true},
+		{name: "v2 short address block", input: string(proxyV2(0x1, 0x1, []byte{192, 0, 2, 1})), malformed: true},
+		{name: "v2 bad version", input: string(append(append([]byte(nil), proxyV2Signature...), 0x11, 0x11, 0, 0)), malformed: true},
+		{name: "v2 bad signature", input: "\r\n\r\n\x00\r\nQUIX\n\x21\x11\x00\x00", malformed: true},
+		{name: "v2 oversized payload", input: string(proxyV2Signature) + "\x21\x11\xff\xff", malformed: true},
+		{name: "v2 truncated head", input: string(proxyV2Signature[:8]), wantErr: true},
+		{name: "v2 truncated payload", input: string(proxyV2(0x1, 0x1, v2IPv4Block([4]byte{192, 0, 2, 1}, [4]byte{198, 51, 100, 1}, 1, 79))[:20]), wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			br := bufio.NewReaderSize(strings.NewReader(tc.input), proxyV2HeadLen+proxyV2MaxPayload)
+			got, err := readProxyHeader(br)
+			switch {
+			case tc.malformed:
+				if !errors.Is(err, errProxyHeaderMalformed) {
+					t.Fatalf("want malformed error, got addr %v err %v", got, err)
+				}
+				return
+			case tc.wantErr:
+				if err == nil {
+					t.Fatalf("want error, got addr %v", got)
+				}
+				return
+			case err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tc.want == "" {
+				if got != nil {
+					t.Fatalf("want nil address, got %v", got)
+				}
+			} else if got == nil || got.String() != tc.want {
+				t.Fatalf("want %s, got %v", tc.want, got)
+			}
+			rest := make([]byte, 100)
+			n, _ := br.Read(rest)
+			if string(rest[:n]) != tc.rest {
+				t.Errorf("left over %q, want %q", rest[:n], tc.rest)
+			}
+		})
+	}
+}
+
+// A client dribbling out a header is stopped by the read deadline which the
+// connection handler sets before reading it.
+func TestReadProxyHeaderSlow(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	go func() {
+		_, _ = client.Write([]byte("PROXY TCP4 "))
+		// and then nothing more
+	}()
+	_ = server.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	start := time.Now()
+	_, err := readProxyHeader(bufio.NewReader(server))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("want deadline exceeded, got %v", err)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Fatalf("took %v to give up", time.Since(start))
+	}
+}
+
+func TestProxyHeaderExpected(t *testing.T) {
+	saved := proxyOpts
+	defer func() { proxyOpts = saved }()
+	if err := proxyOpts.trusted.Set("10.0.0.0/24, 2001:db8:1::/64,192.0.2.5"); err != nil {
+		t.Fatal(err)
+	}
+	proxyOpts.unix = false
+
+	for _, tc := range []struct {
+		peer net.Addr
+		want bool
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("10.0.0.9"), Port: 1}, true},
+		{&net.TCPAddr{IP: net.ParseIP("::ffff:10.0.0.9"), Port: 1}, true},
+		{&net.TCPAddr{IP: net.ParseIP("10.0.1.9"), Port: 1}, false},
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.5"), Port: 1}, true},
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.6"), Port: 1}, false},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8:1::77"), Port: 1}, true},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8:2::77"), Port: 1}, false},
+		{&net.UnixAddr{Name: "/run/fingerd.sock", Net: "unix"}, false},
+	} {
+		if got := proxyHeaderExpected(tc.peer); got != tc.want {
+			t.Errorf("proxyHeaderExpected(%v) = %v, want %v", tc.peer, got, tc.want)
+		}
+	}
+
+	proxyOpts.unix = true
+	if !proxyHeaderExpected(&net.UnixAddr{Name: "/run/fingerd.sock", Net: "unix"}) {
+		t.Error("unix peer not expected to send a header with -proxy-protocol.unix")
+	}
+}
+
+func TestCIDRListFlag(t *testing.T) {
+	var cl cidrList
+	if err := cl.Set("10.0.0.1/8"); err != nil {
+		t.Fatal(err)
+	}
+	if got := cl.String(); got != "10.0.0.0/8" {
+		t.Errorf("prefix not masked: %q", got)
+	}
+	if err := cl.Set("10.0.0.0/33"); err == nil {
+		t.Error("accepted a bad prefix")
+	}
+	if err := cl.Set("not-an-address"); err == nil {
+		t.Error("accepted a bad address")
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright © 2020 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// The query subcommand runs a request through the same code as a network
+// client gets, but in-process: `fingerd query [/W] username...`.  The
+// response goes to stdout, exactly as a client would receive it, and the
+// trace of decisions made goes to stderr, as debug-level logs.  As with
+// `check`, run it as the user the daemon runs as, to see what it sees.
+// With -local-addr, it's as though the client connected to that address, so
+// gets any namespace for it, alias file and all.
+
+func init() {
+	subcommands["query"] = queryMain
+}
+
+func queryMain(args []string) int {
+	var localAddr string
+	fs := flag.NewFlagSet(fingerProgram+" query", flag.ContinueOnError)
+	fs.StringVar(&localAddr, "local-addr", "", "IP or IP:port the query is as though made to, for namespaces")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s query [flags] [/W] username...\n", fingerProgram)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	args = fs.Args()
+	if len(args) == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	cfg, err := buildSettings()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s query: %v\n", fingerProgram, err)
+		return 2
+	}
+	conn := &memConn{request: strings.NewReader(strings.Join(args, " ") + "\r\n")}
+	if localAddr != "" {
+		ap, err := parseNamespaceAddress(localAddr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s query: -local-addr: %v\n", fingerProgram, err)
+			return 2
+		}
+		conn.local = net.TCPAddrFromAddrPort(ap)
+		cfg = cfg.forLocalAddr(conn.local)
+	}
+
+	logger := logrus.New()
+	logger.Out = os.Stderr
+	logger.SetLevel(logrus.DebugLevel)
+	if logOpts.json {
+		logger.Formatter = &logrus.JSONFormatter{}
+	}
+
+	if cfg.aliasFile != "" {
+		loadAliasFile(cfg.aliasFile, true, logger)
+	}
+	if passwdIndexWanted() {
+		loadPasswdIndex(logger)
+	}
+	if err := setupLDAP(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s query: %v\n", fingerProgram, err)
+		return 2
+	}
+	if err := checkForwardOpts(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s query: %v\n", fingerProgram, err)
+		return 2
+	}
+
+	c := &FingerConnection{
+		Entry:      logger.WithField("query", true),
+		conn:       conn,
+		remote:     conn.RemoteAddr(),
+		acceptedAt: time.Now(),
+		cfg:        cfg,
+	}
+	if cfg.namespace != "" {
+		c.Entry = c.WithField("namespace", cfg.namespace)
+	}
+	written := c.serveRequest()
+	c.WithField("written", written).Debug("done")
+
+	_, _ = os.Stdout.Write(conn.response.Bytes())
+	return 0
+}
+
+// memConn is a net.Conn for a request already known and a response to be
+// kept; deadlines are meaningless, so are ignored.
+type memConn struct {
+	request  *strings.Reader
+	response bytes.Buffer
+	local    net.Addr // nil for memAddr
+}
+
+type memAddr struct{}
+
+func (memAddr) Network() string { return "memory" }
+func (memAddr) String() string  { return "query" }
+
+func (m *memConn) Read(b []byte) (int, error)  { return m.request.Read(b) }
+func (m *memConn) Write(b []byte) (int, error) { return m.response.Write(b) }
+func (m *memConn) Close() error                { return nil }
+func (m *memConn) LocalAddr() net.Addr {
+	if m.local != nil {
+		return m.local
+	}
+	return memAddr{}
+}
+func (m *memConn) RemoteAddr() net.Addr               { return memAddr{} }
+func (m *memConn) SetDeadline(t time.Time) error      { return nil }
+func (m *memConn) SetReadDeadline(t time.Time) error  { return nil }
+func (m *memConn) SetWriteDeadline(t time.Time) error { return nil }
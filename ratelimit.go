@@ -0,0 +1,128 @@
+// Copyright © 2020 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package main
+
+import (
+	"flag"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// Rate-limiting is of user lookups, not of connections, so that one request
+// naming 100 users costs 100 tokens.  Clients are aggregated by network,
+// because anyone with IPv6 has at least a /64 to play with.  It's keyed on the
+// client address after any PROXY header.
+var rateLimitOpts struct {
+	lookups    float64
+	interval   time.Duration
+	burst      float64
+	ipv4Prefix int
+	ipv6Prefix int
+}
+
+func init() {
+	flag.Float64Var(&rateLimitOpts.lookups, "ratelimit.lookups", 0, "user lookups allowed per client network per interval (0 for no limit)")
+	flag.DurationVar(&rateLimitOpts.interval, "ratelimit.interval", time.Minute, "interval over which -ratelimit.lookups applies")
+	flag.Float64Var(&rateLimitOpts.burst, "ratelimit.burst", 0, "max lookups a client network can save up (0 for same as -ratelimit.lookups)")
+	flag.IntVar(&rateLimitOpts.ipv4Prefix, "ratelimit.ipv4-prefix", 32, "prefix length to aggregate IPv4 clients to")
+	flag.IntVar(&rateLimitOpts.ipv6Prefix, "ratelimit.ipv6-prefix", 64, "prefix length to aggregate IPv6 clients to")
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// A lookupRateLimiter gets its rate from a function, so that flags can be
+// read as it goes; forwarded queries have a limiter of their own.  The
+// interval and the aggregation of clients are always -ratelimit.*.
+type lookupRateLimiter struct {
+	sync.Mutex
+	buckets   map[netip.Prefix]*tokenBucket
+	lastSweep time.Time
+	// rate gives the lookups per interval, 0 for no limit, and the burst.
+	rate func() (lookups, burst float64)
+}
+
+func newLookupRateLimiter(rate func() (lookups, burst float64)) *lookupRateLimiter {
+	return &lookupRateLimiter{buckets: make(map[netip.Prefix]*tokenBucket), rate: rate}
+}
+
+var lookupLimits = newLookupRateLimiter(lookupRate)
+
+func lookupRate() (lookups, burst float64) {
+	burst = rateLimitOpts.burst
+	if burst <= 0 {
+		burst = rateLimitOpts.lookups
+	}
+	return rateLimitOpts.lookups, burst
+}
+
+// allow takes one token for the client's network, returning false if there
+// was none to take.  Clients we can't key (unix-domain sockets) are never
+// limited.
+func (rl *lookupRateLimiter) allow(client net.Addr) bool {
+	lookups, burst := rl.rate()
+	if lookups <= 0 || rateLimitOpts.interval <= 0 {
+		return true
+	}
+	// A bucket which can't hold a whole token would never allow anything,
+	// however long the client waited.
+	burst = max(burst, 1)
+	ip, ok := addrToNetip(client)
+	if !ok {
+		return true
+	}
+	bits := rateLimitOpts.ipv6Prefix
+	if ip.Is4() {
+		bits = rateLimitOpts.ipv4Prefix
+	}
+	key, err := ip.Prefix(bits)
+	if err != nil {
+		// bad flag value; fail open, the connection limits still apply
+		return true
+	}
+
+	now := time.Now()
+	perSecond := lookups / rateLimitOpts.interval.Seconds()
+
+	rl.Lock()
+	defer rl.Unlock()
+
+	rl.sweep(now, burst, perSecond)
+
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: burst, last: now}
+		rl.buckets[key] = b
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * perSecond
+		if b.tokens > burst {
+			b.tokens = burst
+		}
+		b.last = now
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// sweep drops buckets which would have refilled to full by now, since they
+// are indistinguishable from a new bucket.  Caller holds the lock.
+func (rl *lookupRateLimiter) sweep(now time.Time, burst, perSecond float64) {
+	if now.Sub(rl.lastSweep) < rateLimitOpts.interval {
+		return
+	}
+	rl.lastSweep = now
+	for k, b := range rl.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*perSecond >= burst {
+			delete(rl.buckets, k)
+		}
+	}
+}
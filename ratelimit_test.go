@@ -0,0 +1,57 @@
+// Copyright © 2020 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLookupRateLimiterFractionalRate(t *testing.T) {
+	saved := rateLimitOpts
+	defer func() { rateLimitOpts = saved }()
+	rateLimitOpts.lookups = 0.5
+	rateLimitOpts.interval = time.Hour
+	rateLimitOpts.burst = 0
+	rateLimitOpts.ipv4Prefix = 32
+	rateLimitOpts.ipv6Prefix = 64
+
+	rl := newLookupRateLimiter(lookupRate)
+	client := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1}
+	if !rl.allow(client) {
+		t.Fatal("first lookup refused with a rate below one per interval")
+	}
+	if rl.allow(client) {
+		t.Fatal("second lookup allowed straight away")
+	}
+}
+
+func TestLookupRateLimiterBurst(t *testing.T) {
+	saved := rateLimitOpts
+	defer func() { rateLimitOpts = saved }()
+	rateLimitOpts.lookups = 10
+	rateLimitOpts.interval = time.Hour
+	rateLimitOpts.burst = 3
+	rateLimitOpts.ipv4Prefix = 24
+	rateLimitOpts.ipv6Prefix = 64
+
+	rl := newLookupRateLimiter(lookupRate)
+	for i := range 3 {
+		// all in the same /24
+		if !rl.allow(&net.TCPAddr{IP: net.IPv4(192, 0, 2, byte(i+1)), Port: 1}) {
+			t.Fatalf("lookup %d refused within burst", i+1)
+		}
+	}
+	if rl.allow(&net.TCPAddr{IP: net.ParseIP("192.0.2.200"), Port: 1}) {
+		t.Fatal("lookup allowed beyond burst")
+	}
+	if !rl.allow(&net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 1}) {
+		t.Fatal("other network refused")
+	}
+	if !rl.allow(&net.UnixAddr{Name: "/run/fingerd.sock", Net: "unix"}) {
+		t.Fatal("unix-domain client limited")
+	}
+}
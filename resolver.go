@@ -0,0 +1,139 @@
+// Copyright © 2020 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// A username is resolved to a user by asking each resolver in the chain
+// (-resolvers) in turn.  A resolver which doesn't know the name passes; one
+// which does either finds the user or denies them, and either way, that's
+// the answer.  Resolvers which aren't configured (passwd without
+// -passwd.min-uid, etc) always pass, so the default chain has everything.
+//
+// The aliases resolver is different: it rewrites the name for the resolvers
+// after it, unless the alias is to a static file, when it finds that.
+
+type resolution int
+
+const (
+	resolveNext   resolution = iota // not known here, try the next
+	resolveFound                    // this is the user
+	resolveDenied                   // known here, and not to be shown; stop
+)
+
+func (r resolution) String() string {
+	switch r {
+	case resolveNext:
+		return "next"
+	case resolveFound:
+		return "found"
+	case resolveDenied:
+		return "denied"
+	}
+	return fmt.Sprintf("resolution(%d)", int(r))
+}
+
+// userQuery is what resolvers are given; username is already sanitized and
+// lower-cased, and may be changed by a resolver for those after it.
+type userQuery struct {
+	cfg      *settings
+	username string
+	log      logrus.FieldLogger
+}
+
+type userResolver interface {
+	resolve(q *userQuery) (fingerUser, resolution)
+}
+
+// resolverFunc lets a plain function be a userResolver.
+type resolverFunc func(q *userQuery) (fingerUser, resolution)
+
+func (f resolverFunc) resolve(q *userQuery) (fingerUser, resolution) { return f(q) }
+
+// userResolvers is populated from init() in each file providing a resolver.
+var userResolvers = make(map[string]userResolver)
+
+func registerResolver(name string, r userResolver) {
+	if _, dup := userResolvers[name]; dup {
+		panic("duplicate user resolver " + name)
+	}
+	userResolvers[name] = r
+}
+
+func resolverNames() []string {
+	names := make([]string, 0, len(userResolvers))
+	for n := range userResolvers {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// defaultResolverChain is the fixed order from before the chain was
+// configurable, with virtual homes after real ones: a login name always wins
+// over someone's real name.
+var defaultResolverChain = resolverChain{"aliases", "passwd", "ldap", "homes", "virtual", "realname"}
+
+// resolverChain is the -resolvers flag, a comma-separated list.
+type resolverChain []string
+
+func (rc *resolverChain) String() string {
+	if rc == nil {
+		return ""
+	}
+	return strings.Join(*rc, ",")
+}
+
+func (rc *resolverChain) Set(value string) error {
+	return rc.SetList(strings.Split(value, ","))
+}
+
+func (rc *resolverChain) SetList(values []string) error {
+	var out resolverChain
+	seen := make(map[string]bool)
+	for _, name := range values {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if _, ok := userResolvers[name]; !ok {
+			return fmt.Errorf("unknown resolver %q (known: %s)", name, strings.Join(resolverNames(), ", "))
+		}
+		if seen[name] {
+			return fmt.Errorf("resolver %q listed twice", name)
+		}
+		seen[name] = true
+		out = append(out, name)
+	}
+	*rc = out
+	return nil
+}
+
+func (rc *resolverChain) List() []string {
+	return append([]string(nil), *rc...)
+}
+
+// resolveUser runs the chain.
+func resolveUser(q *userQuery) (fingerUser, bool) {
+	for _, name := range q.cfg.resolvers {
+		u, res := userResolvers[name].resolve(q)
+		if res == resolveNext {
+			continue
+		}
+		q.log.WithFields(logrus.Fields{
+			"resolver":   name,
+			"resolution": res.String(),
+		}).Debug("resolver answered")
+		return u, res == resolveFound
+	}
+	q.log.Debug("no resolver knew the user")
+	return fingerUser{}, false
+}
@@ -7,16 +7,20 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
+
+	"github.com/sirupsen/logrus"
 )
 
 // text should not include the newline
-func (c *TCPFingerConnection) sendLine(text string) (written int64) {
+func (c *FingerConnection) sendLine(text string) (written int64) {
 	pad := 2
 	if !c.crlf {
 		pad = 1
@@ -31,81 +35,99 @@ func (c *TCPFingerConnection) sendLine(text string) (written int64) {
 		b[l] = '\n'
 	}
 
-	c.conn.SetWriteDeadline(time.Now().Add(opts.requestWriteTimeout))
+	c.conn.SetWriteDeadline(time.Now().Add(c.cfg.requestWriteTimeout))
 	// stdlib net/fd_unix.go (*netFD).Write() handles short writes for us
 	n, err := c.conn.Write(b)
 	if err != nil {
 		c.WithError(err).WithField("wrote", n).Info("write error")
+		noteIOError("write", err)
 		c.writeError = true
 	}
 	return int64(n)
 }
 
-func (c *TCPFingerConnection) sendOops(prefix string) (written int64) {
+func (c *FingerConnection) sendOops(prefix string) (written int64) {
 	if prefix != "" {
 		return c.sendLine(fmt.Sprintf("%s: %s", prefix, "oops"))
 	}
 	return c.sendLine("oops")
 }
 
-func (c *TCPFingerConnection) processUser() (written int64) {
-	// don't vary the output in different scenarios:
-	var noSuchUserText = fmt.Sprintf("%q: no such user", c.username)
+// noSuchUserText is used for every flavour of "we won't tell you about
+// them"; don't vary the output in different scenarios.
+func noSuchUserText(username string) string {
+	return fmt.Sprintf("%q: no such user", username)
+}
+
+func (c *FingerConnection) processUser() (written int64) {
+	notFound := noSuchUserText(c.username)
 
-	u, ok := findUser(c.username, c.Entry)
+	if forwardingEnabled() && strings.Contains(c.username, "@") {
+		return c.forwardQuery()
+	}
+
+	u, ok := findUser(c.cfg, c.username, c.Entry)
 	if !ok {
 		// caller has already set up logging context to include username= field
 		c.Info("unknown user")
-		return c.sendLine(noSuchUserText)
+		metricRequests.WithLabelValues(outcomeUnknownUser).Inc()
+		return c.sendLine(notFound)
 	}
 
 	// Static files as returned from aliases bypass "owner" checks
 	if u.staticFile != "" {
+		metricRequests.WithLabelValues(outcomeStaticFile).Inc()
 		return c.sendFile(u.staticFile, "")
 	}
 
 	// let sendFile apply ownership checks (symlink attacks, etc)
 	// (if u.uid not set, that just means no ownership checks)
 	c.uid = u.uid
+	c.anyOwner = u.anyOwner
 
 	c.homeDir = u.homeDir
 
 	if c.homeFileStat(".nofinger") != nil {
 		c.Info("user denies existence (.nofinger)")
-		return c.sendLine(noSuchUserText)
+		metricRequests.WithLabelValues(outcomeNoFinger).Inc()
+		return c.sendLine(notFound)
 	}
 
-	haveProject := c.homeFileStat(".project")
-	havePlan := c.homeFileStat(".plan")
-	havePubkey := c.homeFileStat(".pubkey")
-	if !(havePlan != nil || haveProject != nil || havePubkey != nil) {
+	files := userFiles.files
+	stats := make([]os.FileInfo, len(files))
+	exists := false
+	for i := range files {
+		stats[i] = c.homeFileStat(files[i].filename)
+		if stats[i] != nil && files[i].required {
+			exists = true
+		}
+	}
+	if !exists {
 		c.Info("user missing finger files, denying existence")
-		return c.sendLine(noSuchUserText)
+		metricRequests.WithLabelValues(outcomeMissingFiles).Inc()
+		return c.sendLine(notFound)
 	}
 
 	// We now will admit that the user does exist (real or alias)
+	metricRequests.WithLabelValues(outcomeServed).Inc()
 
-	written += c.sendLine(fmt.Sprintf("User: %s", c.username))
+	written += c.sendLine(c.userHeader(u))
 	if c.writeError {
 		return
 	}
-
-	if haveProject != nil && c.homeFileValid(haveProject) {
-		written += c.sendFile(".project", "Project")
+	if c.long {
+		written += c.sendLongFields(u)
 		if c.writeError {
 			return
 		}
 	}
-	if havePlan != nil && c.homeFileValid(havePlan) {
-		written += c.sendFile(".plan", "Plan")
-	} else {
-		written += c.sendLine("No Plan.")
-	}
-	if c.writeError {
-		return
-	}
-	if havePubkey != nil && c.homeFileValid(havePubkey) {
-		written += c.sendFile(".pubkey", "Public key")
+
+	for i := range files {
+		if stats[i] != nil && c.homeFileValid(stats[i]) {
+			written += c.sendFile(files[i].filename, files[i].caption)
+		} else if files[i].fallback != "" {
+			written += c.sendLine(files[i].fallback)
+		}
 		if c.writeError {
 			return
 		}
@@ -114,9 +136,16 @@ func (c *TCPFingerConnection) processUser() (written int64) {
 	return
 }
 
-func (c *TCPFingerConnection) homeFileStat(filename string) os.FileInfo {
+// homeFileStat follows symlinks, except where the owner isn't checked: there,
+// nothing would stop a symlink pointing anywhere we can read, so we see the
+// link itself and homeFileValid refuses it.
+func (c *FingerConnection) homeFileStat(filename string) os.FileInfo {
 	pathname := filepath.Join(c.homeDir, filename)
-	fi, err := os.Stat(pathname)
+	stat := os.Stat
+	if c.anyOwner {
+		stat = os.Lstat
+	}
+	fi, err := stat(pathname)
 	if err != nil {
 		if os.IsNotExist(err) || os.IsPermission(err) {
 			return nil
@@ -127,19 +156,25 @@ func (c *TCPFingerConnection) homeFileStat(filename string) os.FileInfo {
 	return fi
 }
 
-func (c *TCPFingerConnection) homeFileValid(fi os.FileInfo) bool {
+func (c *FingerConnection) homeFileValid(fi os.FileInfo) bool {
 	if fi.Size() == 0 {
+		c.WithField("filename", fi.Name()).Debug("ignoring empty file")
 		return false
 	}
-	// In code at time this comment was written, we use Stat not Lstat, so a
+	// We use Stat not Lstat, except for anyOwner trees, so otherwise a
 	// ModeSymlink means that the symlink was dangling.  So is invalid.
 	switch fi.Mode() & os.ModeType {
 	case 0:
 		break
 	case os.ModeSymlink:
+		if c.anyOwner {
+			c.WithField("filename", fi.Name()).Info("ignoring symlink where owner not checked")
+			return false
+		}
 		c.WithField("filename", fi.Name()).Warn("bug in code: got a symlink result")
 		return false
 	default:
+		c.WithField("filename", fi.Name()).Debug("ignoring non-regular file")
 		return false
 	}
 	stat, ok := fi.Sys().(*syscall.Stat_t)
@@ -152,29 +187,74 @@ func (c *TCPFingerConnection) homeFileValid(fi os.FileInfo) bool {
 	// This check is based upon stat of filenames, we repeat below based upon
 	// stat of opened files, to avoid time-of-test-to-time-of-use (TOTTTOU)
 	// attacks.
-	if stat.Uid != c.uid {
+	if !c.anyOwner && stat.Uid != c.uid {
 		c.WithField("filename", fi.Name()).Warnf("Local user possible attack; pretending non-existent because owned %d but expected %d", stat.Uid, c.uid)
 		return false
 	}
 	return true
 }
 
+// readSmallHomeFile is for files in the home-dir which configure us, rather
+// than being sent; it applies the same checks as sendFile, and returns nil
+// for anything unusable.
+func (c *FingerConnection) readSmallHomeFile(filename string, limit int64) []byte {
+	fi := c.homeFileStat(filename)
+	if fi == nil || !c.homeFileValid(fi) || fi.Size() > limit {
+		return nil
+	}
+	f, err := c.openHomeFile(filepath.Join(c.homeDir, filename))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	ofi, err := f.Stat()
+	if err != nil || !ofi.Mode().IsRegular() {
+		return nil
+	}
+	if c.uid != 0 {
+		// repeat the ownership check against the opened file (TOTTTOU)
+		stat, ok := ofi.Sys().(*syscall.Stat_t)
+		if !ok || stat.Uid != c.uid {
+			return nil
+		}
+	}
+	content, err := io.ReadAll(io.LimitReader(f, limit))
+	if err != nil {
+		c.WithError(err).WithField("filename", filename).Info("error reading")
+		return nil
+	}
+	return content
+}
+
+// openHomeFile repeats the no-symlink rule of homeFileStat against the file
+// we actually open, in case a link was swapped in after the stat.
+func (c *FingerConnection) openHomeFile(pathname string) (*os.File, error) {
+	if c.anyOwner {
+		return os.OpenFile(pathname, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	}
+	return os.Open(pathname)
+}
+
 // sendFile returns either the amount written _or_ that nothing was written; if nothing
 // was written, we treat it as not a problem as long as it's a permissions issue
-func (c *TCPFingerConnection) sendFile(filename, prefix string) (written int64) {
+func (c *FingerConnection) sendFile(filename, prefix string) (written int64) {
 	if c.homeDir != "" && !filepath.IsAbs(filename) {
 		filename = filepath.Join(c.homeDir, filename)
 	}
 	// We expect the existence of the file to have already been established.
 	// So this should be rare; there's a risk via race if the user is mutating
 	// their homedir under us.
-	f, err := os.Open(filename)
+	f, err := c.openHomeFile(filename)
 	log := c.WithField("file", filename)
 	if err != nil {
 		if os.IsPermission(err) {
 			log.Info("permission denied, pretending non-existent")
 			return 0
 		}
+		if errors.Is(err, syscall.ELOOP) {
+			log.Info("symlink where owner not checked, pretending non-existent")
+			return 0
+		}
 		log.WithError(err).Warn("can't open to send")
 		return c.sendOops(prefix)
 	}
@@ -191,8 +271,8 @@ func (c *TCPFingerConnection) sendFile(filename, prefix string) (written int64)
 		return 0
 	}
 
-	if fi.Size() > opts.fileSizeLimit {
-		log.Infof("pretending non-existent because file too large (%d > %d)", fi.Size(), opts.fileSizeLimit)
+	if fi.Size() > c.cfg.fileSizeLimit {
+		log.Infof("pretending non-existent because file too large (%d > %d)", fi.Size(), c.cfg.fileSizeLimit)
 		return 0
 	}
 
@@ -226,29 +306,27 @@ func (c *TCPFingerConnection) sendFile(filename, prefix string) (written int64)
 	// large", at time of stat, but the file could be open for writing
 	// concurrently, so we _still_ want to use a LimitReader.  This will also
 	// protect against virtual file-systems which get sizes wrong, etc etc.
-	b := bufio.NewReaderSize(io.LimitReader(f, opts.fileSizeLimit), int(opts.fileSizeLimit+1))
+	b := bufio.NewReaderSize(io.LimitReader(f, c.cfg.fileSizeLimit), int(c.cfg.fileSizeLimit+1))
 
 	// Page things into memory from disk before we set network write deadlines
-	// (while we're at it, if it's short enough, check for a newline in the first
-	//  line, for prefix-joining)
-	embeddedNewline := true
+	// (while we're at it, if it's all one line, find how long that line will
+	//  be once sanitized, for prefix-joining; escaping can lengthen it and
+	//  stripping shorten it, so the size on disk won't do)
+	loneLineLen := -1
 	func() {
-		if fi.Size() > 80 {
-			_, _ = b.Peek(int(fi.Size()))
-			return
-		}
 		peekAhead, _ := b.Peek(int(fi.Size()))
-		if !bytes.ContainsRune(peekAhead, '\n') {
-			embeddedNewline = false
-		} else if bytes.IndexRune(peekAhead, '\n') == int(fi.Size()-1) {
-			embeddedNewline = false
+		line := bytes.TrimSuffix(peekAhead, []byte{'\n'})
+		if bytes.ContainsRune(line, '\n') {
+			return
 		}
+		line, _ = sanitizeLine(bytes.TrimSuffix(line, []byte{'\r'}), outputOpts.sanitize, outputOpts.strip)
+		loneLineLen = len(line)
 	}()
 
 	// One deadline per file contents; we'll reset between multiple files
 	// for each user, as that strictly bounds how much a user can extend the
 	// timeout, but we don't want to deal with a slowloris reader.
-	c.conn.SetWriteDeadline(time.Now().Add(opts.requestWriteTimeout))
+	c.conn.SetWriteDeadline(time.Now().Add(c.cfg.requestWriteTimeout))
 
 	if prefix != "" {
 		// If the caption/prefix is short enough, we put it on one line.
@@ -259,7 +337,7 @@ func (c *TCPFingerConnection) sendFile(filename, prefix string) (written int64)
 		copy(buf, prefix)
 		buf[l] = ':'
 		l++
-		if int(fi.Size()) < (75-l) && !embeddedNewline {
+		if loneLineLen >= 0 && loneLineLen < (75-l) {
 			buf[l] = ' '
 			buf = buf[:l+1]
 		} else if c.crlf {
@@ -275,12 +353,14 @@ func (c *TCPFingerConnection) sendFile(filename, prefix string) (written int64)
 
 		if err != nil {
 			log.WithError(err).Info("error writing prefix")
+			noteIOError("write", err)
 			c.writeError = true
 			c.conn.SetWriteDeadline(time.Time{})
 			return written
 		}
 	}
 
+	linesAltered := 0
 	for {
 		// ReadLine's API doesn't indicate missing final newline but that's fine,
 		// because we want to send one even if it's missing from the file.  So it's
@@ -297,10 +377,15 @@ func (c *TCPFingerConnection) sendFile(filename, prefix string) (written int64)
 			log.WithError(err).Info("encountered error while reading")
 			break
 		}
+		chunk, altered := sanitizeLine(chunk, outputOpts.sanitize, outputOpts.strip)
+		if altered {
+			linesAltered++
+		}
 		n, err := c.conn.Write(chunk)
 		written += int64(n)
 		if err != nil {
 			log.WithError(err).Infof("error returning file (wrote %d)", written)
+			noteIOError("write", err)
 			c.writeError = true
 			break
 		}
@@ -309,6 +394,7 @@ func (c *TCPFingerConnection) sendFile(filename, prefix string) (written int64)
 			written += int64(n)
 			if err != nil {
 				log.WithError(err).Infof("error returning file (wrote %d)", written)
+				noteIOError("write", err)
 				c.writeError = true
 				break
 			}
@@ -317,5 +403,12 @@ func (c *TCPFingerConnection) sendFile(filename, prefix string) (written int64)
 
 	c.conn.SetWriteDeadline(time.Time{})
 
+	if linesAltered > 0 {
+		log.WithFields(logrus.Fields{
+			"lines-altered": linesAltered,
+			"sanitize":      outputOpts.sanitize,
+		}).Info("sanitized file contents")
+	}
+
 	return written
 }
@@ -0,0 +1,166 @@
+// Copyright © 2020 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"unicode/utf8"
+)
+
+// RFC 1288 section 3.3 warns that users' files can carry control characters
+// aimed at the terminal of whoever fingers them.  We filter each line of
+// served files: in utf8 mode, invalid UTF-8, C0 and C1 controls (other than
+// tab) and whole ANSI escape sequences (CSI, OSC and the like) are made
+// visible, as `\x1b[31m` etc; ascii mode also does that to anything outside
+// ASCII.  With -output.sanitize-strip they're removed instead.  raw mode
+// sends the bytes as they are on disk.
+
+const (
+	sanitizeRaw   = "raw"
+	sanitizeUTF8  = "utf8"
+	sanitizeASCII = "ascii"
+)
+
+type sanitizeMode string
+
+func (m *sanitizeMode) String() string { return string(*m) }
+
+func (m *sanitizeMode) Set(value string) error {
+	switch value {
+	case sanitizeRaw, sanitizeUTF8, sanitizeASCII:
+		*m = sanitizeMode(value)
+		return nil
+	}
+	return fmt.Errorf("unknown sanitize mode %q (want %s, %s or %s)", value, sanitizeRaw, sanitizeUTF8, sanitizeASCII)
+}
+
+var outputOpts struct {
+	sanitize sanitizeMode
+	strip    bool
+}
+
+func init() {
+	outputOpts.sanitize = sanitizeUTF8
+	flag.Var(&outputOpts.sanitize, "output.sanitize", "filter for served files: raw, utf8 or ascii")
+	flag.BoolVar(&outputOpts.strip, "output.sanitize-strip", false, "remove, rather than visibly escape, what -output.sanitize filters")
+}
+
+// sanitizeLine returns the line to send, which is the line given if nothing
+// needed changing; the line excludes its terminator.
+func sanitizeLine(line []byte, mode sanitizeMode, strip bool) (out []byte, altered bool) {
+	if mode == sanitizeRaw {
+		return line, false
+	}
+	ascii := mode == sanitizeASCII
+	if !needsSanitizing(line, ascii) {
+		return line, false
+	}
+
+	out = make([]byte, 0, len(line)+16)
+	for i := 0; i < len(line); {
+		r, size := utf8.DecodeRune(line[i:])
+		switch {
+		case r == utf8.RuneError && size == 1:
+			if !strip {
+				out = fmt.Appendf(out, `\x%02x`, line[i])
+			}
+		case r == '\t':
+			out = append(out, '\t')
+		case r < 0x20, r == 0x7f, r >= 0x80 && r < 0xa0:
+			if strip {
+				// take the rest of any escape sequence with it, so as not
+				// to leave `[31m` litter behind
+				size = escapeSequenceLen(line[i:])
+			} else {
+				out = append(out, escapeRune(r)...)
+			}
+		case ascii && r >= 0x80:
+			if !strip {
+				out = append(out, escapeRune(r)...)
+			}
+		default:
+			out = append(out, line[i:i+size]...)
+		}
+		i += size
+	}
+	return out, true
+}
+
+// sanitizeString is for text from elsewhere which we put into a line of our
+// own, such as a GECOS field.
+func sanitizeString(s string) string {
+	out, _ := sanitizeLine([]byte(s), outputOpts.sanitize, outputOpts.strip)
+	return string(out)
+}
+
+func needsSanitizing(line []byte, ascii bool) bool {
+	for i := 0; i < len(line); {
+		r, size := utf8.DecodeRune(line[i:])
+		switch {
+		case r == utf8.RuneError && size == 1:
+			return true
+		case r == '\t':
+		case r < 0x20, r == 0x7f, r >= 0x80 && r < 0xa0:
+			return true
+		case ascii && r >= 0x80:
+			return true
+		}
+		i += size
+	}
+	return false
+}
+
+// escapeSequenceLen returns the length of the ANSI (ECMA-48) sequence which b
+// starts with, or of the first control character if not a sequence.  An
+// unterminated sequence runs to the end of b.
+func escapeSequenceLen(b []byte) int {
+	r, size := utf8.DecodeRune(b)
+	var kind rune
+	switch {
+	case r == 0x1b && len(b) > 1:
+		// 7-bit forms: ESC [ is CSI, ESC ] is OSC, etc
+		switch b[1] {
+		case '[', ']', 'P', 'X', '^', '_':
+			kind = rune(b[1]) + 0x40
+			size = 2
+		default:
+			if b[1] >= 0x20 && b[1] <= 0x7e {
+				return 2
+			}
+			return 1
+		}
+	case r == 0x9b, r == 0x9d, r == 0x90, r == 0x98, r == 0x9e, r == 0x9f:
+		kind = r
+	default:
+		return size
+	}
+
+	if kind == 0x9b {
+		// CSI: parameter and intermediate bytes, then a final byte
+		for i := size; i < len(b); i++ {
+			if b[i] >= 0x40 && b[i] <= 0x7e {
+				return i + 1
+			}
+			if b[i] < 0x20 || b[i] > 0x7e {
+				return i // malformed, so that's the end of it
+			}
+		}
+		return len(b)
+	}
+	// OSC and the other string types: terminated by ST (ESC \ or 0x9c) or,
+	// by common practice for OSC, BEL
+	for i := size; i < len(b); i++ {
+		switch {
+		case b[i] == 0x07:
+			return i + 1
+		case b[i] == 0x1b && i+1 < len(b) && b[i+1] == '\\':
+			return i + 2
+		case b[i] == 0xc2 && i+1 < len(b) && b[i+1] == 0x9c:
+			return i + 2
+		}
+	}
+	return len(b)
+}
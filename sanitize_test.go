@@ -0,0 +1,114 @@
+// Copyright © 2020 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSanitizeLine(t *testing.T) {
+	const (
+		raw   = sanitizeMode(sanitizeRaw)
+		utf   = sanitizeMode(sanitizeUTF8)
+		ascii = sanitizeMode(sanitizeASCII)
+	)
+	for _, tc := range []struct {
+		name  string
+		mode  sanitizeMode
+		strip bool
+		in    string
+		want  string // "" for unaltered
+	}{
+		{name: "plain", mode: utf, in: "hello, world"},
+		{name: "tab", mode: utf, in: "a\tb"},
+		{name: "tab ascii", mode: ascii, in: "a\tb"},
+		{name: "tab strip", mode: ascii, strip: true, in: "a\tb"},
+		{name: "utf8 text", mode: utf, in: "café ☕"},
+		{name: "C0", mode: utf, in: "a\x07b\x00c", want: `a\x07b\x00c`},
+		{name: "CR", mode: utf, in: "a\rb", want: `a\rb`},
+		{name: "DEL", mode: utf, in: "a\x7fb", want: `a\x7fb`},
+		{name: "C1", mode: utf, in: "a\u0085b", want: `a\u0085b`},
+		{name: "invalid UTF-8", mode: utf, in: "a\xffb", want: `a\xffb`},
+		{name: "CSI", mode: utf, in: "\x1b[31mred\x1b[0m", want: `\x1b[31mred\x1b[0m`},
+		{name: "8-bit CSI", mode: utf, in: "\u009b31mred", want: `\u009b31mred`},
+		{name: "OSC", mode: utf, in: "\x1b]0;title\x07text", want: `\x1b]0;title\x07text`},
+		{name: "ascii non-ascii", mode: ascii, in: "café", want: `caf\u00e9`},
+		{name: "ascii astral", mode: ascii, in: "\U0001F600", want: `\U0001f600`},
+		{name: "ascii CSI", mode: ascii, in: "\x1b[1mbold", want: `\x1b[1mbold`},
+
+		{name: "strip C0", mode: utf, strip: true, in: "a\x07b", want: "ab"},
+		{name: "strip C1", mode: utf, strip: true, in: "a\u0085b", want: "ab"},
+		{name: "strip invalid", mode: utf, strip: true, in: "a\xffb", want: "ab"},
+		{name: "strip CSI", mode: utf, strip: true, in: "\x1b[31mred\x1b[0m", want: "red"},
+		{name: "strip CSI with intermediates", mode: utf, strip: true, in: "\x1b[?25lx", want: "x"},
+		{name: "strip unterminated CSI", mode: utf, strip: true, in: "x\x1b[31", want: "x"},
+		{name: "strip 8-bit CSI", mode: utf, strip: true, in: "\u009b31mred", want: "red"},
+		{name: "strip OSC BEL", mode: utf, strip: true, in: "\x1b]0;title\x07text", want: "text"},
+		{name: "strip OSC ST", mode: utf, strip: true, in: "\x1b]8;;http://example.com/\x1b\\link", want: "link"},
+		{name: "strip 8-bit OSC", mode: utf, strip: true, in: "\u009d0;title\u009ctext", want: "text"},
+		{name: "strip unterminated OSC", mode: utf, strip: true, in: "x\x1b]0;title", want: "x"},
+		{name: "strip two-byte escape", mode: utf, strip: true, in: "\x1bcreset", want: "reset"},
+		{name: "strip ascii", mode: ascii, strip: true, in: "café\x1b[0m", want: "caf"},
+
+		{name: "raw C0", mode: raw, in: "a\x07b"},
+		{name: "raw CSI", mode: raw, in: "\x1b[31mred"},
+		{name: "raw OSC", mode: raw, strip: true, in: "\x1b]0;title\x07"},
+		{name: "raw invalid", mode: raw, in: "\xff\xfe"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, altered := sanitizeLine([]byte(tc.in), tc.mode, tc.strip)
+			want := tc.want
+			if want == "" {
+				want = tc.in
+			}
+			if string(got) != want {
+				t.Errorf("got %q, want %q", got, want)
+			}
+			if altered != (tc.want != "") {
+				t.Errorf("altered = %v", altered)
+			}
+		})
+	}
+}
+
+// The caption goes on the same line as a file's one line only if what we
+// send, after sanitizing, fits; and files' own line breaks survive.
+func TestSendFileSanitized(t *testing.T) {
+	saved := outputOpts
+	defer func() { outputOpts = saved }()
+
+	for _, tc := range []struct {
+		name     string
+		mode     sanitizeMode
+		strip    bool
+		contents string
+		want     string
+	}{
+		{"short", sanitizeUTF8, false, "Lunch\n", "Plan: Lunch\n"},
+		{"no final newline", sanitizeUTF8, false, "Lunch", "Plan: Lunch\n"},
+		{"CRLF", sanitizeUTF8, false, "Lunch\r\n", "Plan: Lunch\n"},
+		{"lines and tabs kept", sanitizeUTF8, false, "one\ttab\ntwo\n", "Plan:\none\ttab\ntwo\n"},
+		{"escaping lengthens", sanitizeUTF8, false, strings.Repeat("\x07", 20) + "\n", "Plan:\n" + strings.Repeat(`\x07`, 20) + "\n"},
+		{"stripping shortens", sanitizeUTF8, true, "\x1b]0;" + string(make([]byte, 100)) + "\x07Lunch\n", "Plan: Lunch\n"},
+		{"raw", sanitizeRaw, false, "\x1b[1mLunch\n", "Plan: \x1b[1mLunch\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			outputOpts.sanitize = tc.mode
+			outputOpts.strip = tc.strip
+			c, conn := testConnection(t, "")
+			c.homeDir = t.TempDir()
+			if err := os.WriteFile(filepath.Join(c.homeDir, ".plan"), []byte(tc.contents), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			c.sendFile(".plan", "Plan")
+			if got := conn.response.String(); got != tc.want {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright © 2020 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// settings are the knobs which can be changed at runtime, by SIGHUP.  A
+// *settings is never mutated once published via liveSettings, so can be
+// held onto for the lifetime of a connection for a consistent view.
+type settings struct {
+	aliasFile           string
+	homesDir            string
+	minPasswdUID        uint64
+	fileSizeLimit       int64
+	requestReadTimeout  time.Duration
+	requestWriteTimeout time.Duration
+	logLevel            string
+	resolvers           resolverChain
+	virtualHomes        virtualHomeList
+
+	// Not flags: from the config file's namespace tables (namespace.go).
+	// For a namespace's own settings, namespace is its name.
+	namespace  string
+	namespaces []namespace
+}
+
+// startupSettings is the target of the command-line flags; it's only used
+// directly before we start serving, to seed liveSettings.
+var startupSettings settings
+
+var liveSettings atomic.Pointer[settings]
+
+func init() {
+	registerSettingsFlags(flag.CommandLine, &startupSettings)
+	liveSettings.Store(&startupSettings)
+}
+
+// registerSettingsFlags is used both for the command-line and for building a
+// fresh set of settings on reload, so that the defaults and parsing are the
+// same for both.
+func registerSettingsFlags(fs *flag.FlagSet, s *settings) {
+	fs.StringVar(&s.aliasFile, "alias-file", "/etc/finger.conf", "file to read aliases from (if it exists)")
+	fs.StringVar(&s.homesDir, "homes-dir", "/home", "where end-user home-dirs live")
+	fs.DurationVar(&s.requestReadTimeout, "request.timeout.read", 10*time.Second, "timeout for receiving the finger request")
+	fs.DurationVar(&s.requestWriteTimeout, "request.timeout.write", 30*time.Second, "timeout for each write of the response")
+	fs.Int64Var(&s.fileSizeLimit, "file.size-limit", defaultFileSizeLimit, "how large a file we will serve")
+	fs.Uint64Var(&s.minPasswdUID, "passwd.min-uid", 0, "set non-zero to enable passwd lookups")
+	fs.StringVar(&s.logLevel, "log.level", "info", "logging level (\"help\" to list)")
+	s.resolvers = append(resolverChain(nil), defaultResolverChain...)
+	fs.Var(&s.resolvers, "resolvers", "comma-separated order in which to look users up, from: aliases, passwd, ldap, homes, virtual, realname")
+	fs.Var(&s.virtualHomes, "virtual-home", "DIR:OWNER tree of virtual home-dirs, files owned by OWNER (or \"any\" to not check); repeat for more")
+}
+
+func currentSettings() *settings {
+	return liveSettings.Load()
+}
+
+// We buffer files of up to this size in memory, per connection.
+const maxFileSizeLimit = 64 * 1024 * 1024
+
+func (s *settings) validate() error {
+	var errs []error
+	if s.fileSizeLimit <= 0 || s.fileSizeLimit > maxFileSizeLimit {
+		errs = append(errs, fmt.Errorf("file.size-limit %d not in range 1..%d", s.fileSizeLimit, maxFileSizeLimit))
+	}
+	if s.requestReadTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("request.timeout.read %v not positive", s.requestReadTimeout))
+	}
+	if s.requestWriteTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("request.timeout.write %v not positive", s.requestWriteTimeout))
+	}
+	if s.homesDir != "" && !filepath.IsAbs(s.homesDir) {
+		errs = append(errs, fmt.Errorf("homes-dir %q not absolute", s.homesDir))
+	}
+	if len(s.resolvers) == 0 {
+		errs = append(errs, errors.New("resolvers: empty, so nobody could be found"))
+	}
+	if _, err := logrus.ParseLevel(s.logLevel); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// values returns the settings as their flag names and string forms.
+func (s *settings) values() map[string]string {
+	fs := flag.NewFlagSet("values", flag.ContinueOnError)
+	var tmp settings
+	registerSettingsFlags(fs, &tmp) // sets defaults, so overwrite after
+	tmp = *s
+	out := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) { out[f.Name] = f.Value.String() })
+	s.namespaceValues(out)
+	return out
+}
+
+// diffSettings returns the names of the settings which differ, sorted.
+func diffSettings(a, b *settings) []string {
+	av, bv := a.values(), b.values()
+	changed := make([]string, 0, len(av))
+	for k := range av {
+		if av[k] != bv[k] {
+			changed = append(changed, k)
+		}
+	}
+	for k := range bv {
+		if _, ok := av[k]; !ok {
+			changed = append(changed, k)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// reloadSettings re-reads the config file and atomically replaces the live
+// settings; any invalid value rejects the whole reload.  Values given on the
+// command-line still win over the file.
+//
+// The alias files are re-read even if nothing changed, as a manual fallback
+// for when file-watching isn't working.
+func reloadSettings(logger *logrus.Logger, log logrus.FieldLogger) {
+	log = log.WithField("config", opts.configFile)
+
+	fresh, err := buildSettings()
+	if err != nil {
+		log.WithError(err).Error("config reload rejected, keeping current settings")
+		return
+	}
+
+	old := currentSettings()
+	changed := diffSettings(old, fresh)
+	oldValues, newValues := old.values(), fresh.values()
+	for _, name := range changed {
+		log.WithFields(logrus.Fields{
+			"setting": name,
+			"old":     oldValues[name],
+			"new":     newValues[name],
+		}).Info("setting changed")
+	}
+	liveSettings.Store(fresh)
+	log.WithField("changed", len(changed)).Info("configuration reloaded")
+
+	if fresh.logLevel != old.logLevel {
+		lvl, _ := logrus.ParseLevel(fresh.logLevel) // validated above
+		logger.SetLevel(lvl)
+	}
+
+	syncAliasFiles(logger, true)
+}
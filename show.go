@@ -0,0 +1,137 @@
+// Copyright © 2020 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// What we show beyond the users' own files, from passwd or LDAP, so only for
+// users found via those.  The real name goes on the User: line.  In long
+// (/W) mode, we show those other GECOS fields which both the operator allows
+// with -show.long-fields and the user lists in their ~/.fingerfields; users
+// can set these with chfn, so they're the user's to reveal, not ours.
+
+const userFieldsFile = ".fingerfields"
+
+// Bounds reading the opt-in file, which need only be a few words.
+const userFieldsFileLimit = 4096
+
+// gecosField is one of the comma-separated GECOS fields after the name.
+type gecosField struct {
+	name    string
+	caption string
+}
+
+var gecosFields = []gecosField{
+	{"office", "Office"},
+	{"office-phone", "Office Phone"},
+	{"home-phone", "Home Phone"},
+	{"other", "Other"},
+}
+
+// gecosFieldList is a comma-separated list of gecosFields names.
+type gecosFieldList []string
+
+func (gl *gecosFieldList) String() string {
+	if gl == nil {
+		return ""
+	}
+	return strings.Join(*gl, ",")
+}
+
+func (gl *gecosFieldList) Set(value string) error {
+	var out gecosFieldList
+	for item := range strings.SplitSeq(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if gecosFieldIndex(item) < 0 {
+			return fmt.Errorf("unknown GECOS field %q", item)
+		}
+		out = append(out, item)
+	}
+	*gl = out
+	return nil
+}
+
+func gecosFieldIndex(name string) int {
+	for i := range gecosFields {
+		if gecosFields[i].name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+var showOpts struct {
+	realName   bool
+	longFields gecosFieldList
+}
+
+func init() {
+	flag.BoolVar(&showOpts.realName, "show.real-name", false, "show passwd users' real names on the User: line")
+	flag.Var(&showOpts.longFields, "show.long-fields", "GECOS fields users may opt into showing in /W mode (office, office-phone, home-phone, other)")
+}
+
+// splitGECOSFields returns the fields after the name, by name.
+func splitGECOSFields(gecos string) map[string]string {
+	parts := strings.Split(gecos, ",")
+	out := make(map[string]string)
+	for i := 1; i < len(parts) && i <= len(gecosFields); i++ {
+		if v := strings.TrimSpace(parts[i]); v != "" {
+			out[gecosFields[i-1].name] = v
+		}
+	}
+	return out
+}
+
+// userHeader is the first line of the response for a user.
+func (c *FingerConnection) userHeader(u fingerUser) string {
+	if showOpts.realName && u.realName != "" {
+		return fmt.Sprintf("User: %s (%s)", c.username, sanitizeString(u.realName))
+	}
+	return fmt.Sprintf("User: %s", c.username)
+}
+
+// sendLongFields sends, for /W mode, the GECOS fields which the user has
+// opted into, and the directory attributes which the operator has chosen to
+// show (-ldap.show-attrs); the latter are not the user's to set, so need no
+// opt-in.
+func (c *FingerConnection) sendLongFields(u fingerUser) (written int64) {
+	for _, f := range u.extraFields {
+		written += c.sendLine(f.caption + ": " + sanitizeString(f.value))
+		if c.writeError {
+			return
+		}
+	}
+	if len(showOpts.longFields) == 0 || len(u.gecosFields) == 0 {
+		return
+	}
+	content := c.readSmallHomeFile(userFieldsFile, userFieldsFileLimit)
+	if content == nil {
+		return
+	}
+	optedIn := make(map[string]bool)
+	for _, w := range strings.FieldsFunc(string(content), func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\r' || r == '\n'
+	}) {
+		optedIn[strings.ToLower(w)] = true
+	}
+	for _, name := range showOpts.longFields {
+		v, ok := u.gecosFields[name]
+		if !ok || !optedIn[name] {
+			continue
+		}
+		written += c.sendLine(gecosFields[gecosFieldIndex(name)].caption + ": " + sanitizeString(v))
+		if c.writeError {
+			return
+		}
+	}
+	return
+}
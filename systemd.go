@@ -0,0 +1,133 @@
+// Copyright © 2020 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// These are the systemd socket activation protocol, per sd_listen_fds(3).
+const (
+	envKeySystemdPid     = "LISTEN_PID"
+	envKeySystemdFds     = "LISTEN_FDS"
+	envKeySystemdFdNames = "LISTEN_FDNAMES"
+	systemdFdsStart      = 3
+)
+
+// systemdListeners returns true if we were socket-activated and have populated
+// the list.  return false if the caller should start things normally.
+//
+// The FileDescriptorName= of each socket in the unit determines how we treat
+// it: "tcp4" and "tcp6" name the family, "fingers" or a "-tls" suffix (eg,
+// "tcp6-tls") make it a TLS listener.  Any other name (including the systemd
+// default, the unit name) gets a plain listener with the family derived from
+// the bound address.  Unix-domain sockets are always plain.
+func systemdListeners(
+	wg *sync.WaitGroup,
+	shuttingDown <-chan struct{},
+	logger *logrus.Logger,
+) (
+	[]*FingerListener,
+	bool,
+) {
+	pidStr, ok := os.LookupEnv(envKeySystemdPid)
+	if !ok {
+		return nil, false
+	}
+	recoveryLogger := logrus.NewEntry(logger).WithField("env-var", envKeySystemdPid)
+
+	// Whatever happens, these are not for any process we might exec.
+	fdCountStr := os.Getenv(envKeySystemdFds)
+	namesStr := os.Getenv(envKeySystemdFdNames)
+	for _, k := range []string{envKeySystemdPid, envKeySystemdFds, envKeySystemdFdNames} {
+		_ = os.Unsetenv(k) // don't care if it fails, it's a nicety
+	}
+
+	if pid, err := strconv.Atoi(pidStr); err != nil || pid != os.Getpid() {
+		recoveryLogger.WithField("listen-pid", pidStr).Info("systemd socket activation variables not for us, ignoring")
+		return nil, false
+	}
+
+	fdCount, err := strconv.Atoi(fdCountStr)
+	if err != nil || fdCount < 1 {
+		recoveryLogger.WithField(envKeySystemdFds, fdCountStr).Warn("socket activated but no usable fd count, ignoring")
+		return nil, false
+	}
+
+	var names []string
+	if namesStr != "" {
+		names = strings.Split(namesStr, ":")
+	}
+
+	tfls := make([]*FingerListener, 0, fdCount)
+
+	for i := 0; i < fdCount; i++ {
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+		fd := systemdFdsStart + i
+		l := recoveryLogger.WithFields(logrus.Fields{"fd": fd, "fd-name": name})
+
+		f := os.NewFile(uintptr(fd), "systemd:"+name)
+		listener, err := net.FileListener(f)
+		if err != nil {
+			l.WithError(err).Fatal("unable to make a net listener from systemd fd")
+		}
+		// FileListener dup'd the fd, so we can drop the original
+		_ = f.Close()
+		dl, ok := listener.(DeadlineableListener)
+		if !ok {
+			l.Fatalf("net listener from systemd not a usable listener but instead %T", listener)
+		}
+
+		family, mode := systemdNameToListener(name, dl.Addr())
+		fl := &FingerListener{
+			networkFamily: family,
+			mode:          mode,
+			active:        wg,
+			shuttingDown:  shuttingDown,
+			listener:      dl,
+		}
+		fl.setupAfterListen(logger)
+		tfls = append(tfls, fl)
+	}
+
+	return tfls, true
+}
+
+func systemdNameToListener(name string, addr net.Addr) (family, mode string) {
+	mode = listenModePlain
+	base := name
+	if name == "fingers" {
+		mode = listenModeTLS
+		base = ""
+	} else if b, ok := strings.CutSuffix(name, "-tls"); ok {
+		mode = listenModeTLS
+		base = b
+	}
+
+	switch base {
+	case "tcp4", "tcp6":
+		return base, mode
+	}
+
+	switch a := addr.(type) {
+	case *net.UnixAddr:
+		// TLS over a local socket would be pointless
+		return "unix", listenModePlain
+	case *net.TCPAddr:
+		if a.IP.To4() != nil {
+			return "tcp4", mode
+		}
+	}
+	return "tcp6", mode
+}
@@ -0,0 +1,95 @@
+// Copyright © 2020 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// There is no IANA-assigned port for finger-over-TLS, so we don't default to
+// listening; set -tls.listen to enable.  The certificate files are read after
+// dropping privileges, so must be readable by the -run-as-user.
+var tlsOpts struct {
+	listen   string
+	certFile string
+	keyFile  string
+}
+
+func init() {
+	flag.StringVar(&tlsOpts.listen, "tls.listen", "", "address-spec to listen for finger-over-TLS on (empty to disable)")
+	flag.StringVar(&tlsOpts.certFile, "tls.cert", "", "file holding PEM certificate chain for TLS")
+	flag.StringVar(&tlsOpts.keyFile, "tls.key", "", "file holding PEM private key for TLS")
+}
+
+var tlsCertificate struct {
+	sync.RWMutex
+	cert *tls.Certificate
+}
+
+var errNoTLSCertificate = errors.New("no TLS certificate loaded")
+
+func currentTLSCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	tlsCertificate.RLock()
+	defer tlsCertificate.RUnlock()
+	if tlsCertificate.cert == nil {
+		return nil, errNoTLSCertificate
+	}
+	return tlsCertificate.cert, nil
+}
+
+// newTLSServerConfig returns a config which picks up the certificate at
+// handshake time, so that reloads take effect for new connections without
+// touching the listeners.
+func newTLSServerConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: currentTLSCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+}
+
+// loadTLSCertificate returns true if we now have a usable certificate.  A
+// failed load keeps any previously loaded pair: the cert and key are usually
+// replaced as two separate file writes, so we will see a mismatched pair
+// in-between and should keep serving with the old one until the second write
+// lands.
+func loadTLSCertificate(log logrus.FieldLogger) bool {
+	log = log.WithFields(logrus.Fields{
+		"cert": tlsOpts.certFile,
+		"key":  tlsOpts.keyFile,
+	})
+	cert, err := tls.LoadX509KeyPair(tlsOpts.certFile, tlsOpts.keyFile)
+	if err != nil {
+		tlsCertificate.RLock()
+		haveOld := tlsCertificate.cert != nil
+		tlsCertificate.RUnlock()
+		log.WithError(err).WithField("keeping-old", haveOld).Warn("unable to load TLS certificate pair")
+		return haveOld
+	}
+	tlsCertificate.Lock()
+	tlsCertificate.cert = &cert
+	tlsCertificate.Unlock()
+	l := log
+	if cert.Leaf != nil {
+		l = l.WithFields(logrus.Fields{
+			"subject":   cert.Leaf.Subject.String(),
+			"not-after": cert.Leaf.NotAfter,
+		})
+	}
+	l.Info("loaded TLS certificate pair")
+	return true
+}
+
+func scheduleAutoTLSReload(log logrus.FieldLogger) {
+	reload := func(l logrus.FieldLogger) { _ = loadTLSCertificate(l) }
+	watchFileForChanges(tlsOpts.certFile, log, reload)
+	if tlsOpts.keyFile != tlsOpts.certFile {
+		watchFileForChanges(tlsOpts.keyFile, log, reload)
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright © 2020 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// A unix-domain socket is for a local proxy or sidecar to query us; the
+// filesystem permissions on the socket are the access control, so by default
+// we don't let the world in.
+var unixOpts struct {
+	path  string
+	mode  string
+	owner string
+}
+
+func init() {
+	flag.StringVar(&unixOpts.path, "unix.path", "", "path of unix-domain socket to listen on (empty to disable)")
+	flag.StringVar(&unixOpts.mode, "unix.mode", "0660", "permissions (octal) for the unix-domain socket")
+	flag.StringVar(&unixOpts.owner, "unix.owner", "", "user[:group] (names or numbers) to own the unix-domain socket")
+}
+
+// NewUnixFingerListener creates the unix-domain socket listener.  A stale
+// socket left behind by an unclean exit is removed, but only if nothing is
+// answering on it.
+//
+// We bind before dropping privileges, so the socket is created owned by
+// whoever started us; use -unix.owner to hand it over.
+func NewUnixFingerListener(
+	wg *sync.WaitGroup,
+	shuttingDown <-chan struct{},
+	logger *logrus.Logger,
+) (*FingerListener, error) {
+	mode, err := strconv.ParseUint(unixOpts.mode, 8, 32)
+	if err != nil || mode&^0o777 != 0 {
+		return nil, fmt.Errorf("invalid -unix.mode %q", unixOpts.mode)
+	}
+
+	uid, gid, err := parseOwnerSpec(unixOpts.owner)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := removeStaleSocket(unixOpts.path); err != nil {
+		return nil, err
+	}
+
+	// Narrow the umask around the bind so that there's no window where the
+	// socket is more open than asked for; the chmod below is then only ever
+	// widening the permissions.
+	oldMask := syscall.Umask(0o777 &^ int(mode))
+	listener, err := net.Listen("unix", unixOpts.path)
+	syscall.Umask(oldMask)
+	if err != nil {
+		return nil, err
+	}
+	ul, ok := listener.(*net.UnixListener)
+	if !ok {
+		_ = listener.Close()
+		return nil, fmt.Errorf("listened on unix %q but did not get a unix listener (but instead a %T)",
+			unixOpts.path, listener)
+	}
+
+	if err := os.Chmod(unixOpts.path, os.FileMode(mode)); err != nil {
+		_ = ul.Close()
+		return nil, err
+	}
+	if uid != -1 || gid != -1 {
+		if err := os.Lchown(unixOpts.path, uid, gid); err != nil {
+			_ = ul.Close()
+			return nil, err
+		}
+	}
+
+	fl := &FingerListener{
+		networkFamily: "unix",
+		mode:          listenModePlain,
+		active:        wg,
+		shuttingDown:  shuttingDown,
+		listener:      ul,
+	}
+	fl.setupAfterListen(logger)
+	return fl, nil
+}
+
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("refusing to replace non-socket %q", path)
+	}
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		_ = conn.Close()
+		return fmt.Errorf("socket %q is in use by another process", path)
+	}
+	return os.Remove(path)
+}
+
+// parseOwnerSpec takes "user", "user:group" or numeric forms thereof and
+// returns -1 for whichever is not to be changed.
+func parseOwnerSpec(spec string) (uid, gid int, err error) {
+	uid, gid = -1, -1
+	if spec == "" {
+		return
+	}
+	userPart, groupPart, haveGroup := strings.Cut(spec, ":")
+
+	if userPart != "" {
+		if uid, err = strconv.Atoi(userPart); err != nil {
+			u, lerr := user.Lookup(userPart)
+			if lerr != nil {
+				return -1, -1, fmt.Errorf("unknown user in -unix.owner %q: %w", spec, lerr)
+			}
+			// we're ignoring the portability issue here, see dropPrivileges
+			uid, _ = strconv.Atoi(u.Uid)
+			err = nil
+		}
+	}
+
+	if haveGroup && groupPart != "" {
+		if gid, err = strconv.Atoi(groupPart); err != nil {
+			g, lerr := user.LookupGroup(groupPart)
+			if lerr != nil {
+				return -1, -1, fmt.Errorf("unknown group in -unix.owner %q: %w", spec, lerr)
+			}
+			gid, _ = strconv.Atoi(g.Gid)
+			err = nil
+		}
+	}
+
+	if uid == -1 && gid == -1 {
+		return -1, -1, errors.New("-unix.owner given but names neither user nor group")
+	}
+	return uid, gid, nil
+}
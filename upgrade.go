@@ -0,0 +1,153 @@
+// Copyright © 2020 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// On SIGUSR2 we start a new copy of whatever binary is now at os.Args[0],
+// handing it our listening sockets with the same FINGERD_fdstatus mechanism
+// used when dropping privileges.  The child tells us it's serving by writing
+// to a pipe; only then do we stop accepting and drain.  If the child dies or
+// dawdles, we carry on serving.  Waiting for it doesn't hold up the other
+// signals: a second SIGUSR2 meanwhile is refused, and shutting down abandons
+// the upgrade, stopping the new process.
+//
+// This does fork/exec, unlike dropPrivileges, so is not for when we're the
+// init of a process namespace: the old process exiting would take down the
+// namespace.
+const envKeyUpgradeReady = "FINGERD_upgrade_ready"
+
+const upgradeReadyMessage = "ready\n"
+
+var upgradeOpts struct {
+	timeout time.Duration
+}
+
+func init() {
+	flag.DurationVar(&upgradeOpts.timeout, "upgrade.timeout", 30*time.Second, "on SIGUSR2, how long to wait for the new process to be ready")
+}
+
+// upgradeBinary returns the pid of the new process once it is serving; closing
+// abort stops the wait, and the new process.
+func upgradeBinary(tfls []*FingerListener, abort <-chan struct{}, log logrus.FieldLogger) (int, error) {
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer readyR.Close()
+	waited := make(chan struct{})
+	defer close(waited)
+
+	// fds 0-2 are stdio, then the listeners, then the readiness pipe
+	files := []*os.File{os.Stdin, os.Stdout, os.Stderr}
+	toClose := []*os.File{readyW}
+	defer func() {
+		for _, f := range toClose {
+			_ = f.Close()
+		}
+	}()
+
+	listeningFds := ""
+	for i := range tfls {
+		f, err := tfls[i].listener.File()
+		if err != nil {
+			return 0, fmt.Errorf("unable to get fd from listener (%s): %w", tfls[i].networkFamily, err)
+		}
+		toClose = append(toClose, f)
+		listeningFds += tfls[i].networkFamily + ":" + strconv.Itoa(len(files)) + ":" + tfls[i].mode + "\n"
+		files = append(files, f)
+	}
+	readyFd := len(files)
+	files = append(files, readyW)
+
+	env := make([]string, 0, len(os.Environ())+2)
+	for _, kv := range os.Environ() {
+		if strings.HasPrefix(kv, envKeyFdPassing+"=") || strings.HasPrefix(kv, envKeyUpgradeReady+"=") {
+			continue
+		}
+		env = append(env, kv)
+	}
+	env = append(env, envKeyFdPassing+"="+listeningFds, envKeyUpgradeReady+"="+strconv.Itoa(readyFd))
+
+	proc, err := os.StartProcess(os.Args[0], os.Args, &os.ProcAttr{
+		Env:   env,
+		Files: files,
+	})
+	if err != nil {
+		return 0, err
+	}
+	log = log.WithField("new-pid", proc.Pid)
+	log.Info("started new process, waiting for it to be ready")
+
+	// Our copy of the write end must be closed for us to see EOF if the
+	// child dies.
+	_ = readyW.Close()
+	toClose = toClose[1:]
+
+	_ = readyR.SetReadDeadline(time.Now().Add(upgradeOpts.timeout))
+	go func() {
+		select {
+		case <-abort:
+			_ = readyR.SetReadDeadline(aLongTimeAgo)
+		case <-waited:
+		}
+	}()
+	line, err := bufio.NewReader(readyR).ReadString('\n')
+	if err != nil || line != upgradeReadyMessage {
+		// The reaper will collect it if it's dead; if it's merely slow, it's
+		// going to be fighting us for connections, so stop it.
+		_ = proc.Kill()
+		if err == nil {
+			err = fmt.Errorf("unexpected readiness message %q", line)
+		}
+		return 0, fmt.Errorf("new process %d not ready: %w", proc.Pid, err)
+	}
+	pid := proc.Pid // Release() clobbers this
+	_ = proc.Release()
+	return pid, nil
+}
+
+// signalUpgradeReady is called by the new process once it's serving.
+func signalUpgradeReady(log logrus.FieldLogger) {
+	fdStr, ok := os.LookupEnv(envKeyUpgradeReady)
+	if !ok {
+		return
+	}
+	_ = os.Unsetenv(envKeyUpgradeReady)
+	log = log.WithField("env-var", envKeyUpgradeReady)
+	fd, err := strconv.Atoi(fdStr)
+	if err != nil {
+		log.WithError(err).Warn("malformed readiness fd")
+		return
+	}
+	f := os.NewFile(uintptr(fd), "upgrade-ready")
+	if f == nil {
+		log.Warn("invalid readiness fd")
+		return
+	}
+	if _, err := f.WriteString(upgradeReadyMessage); err != nil {
+		log.WithError(err).Warn("unable to tell old process we're ready")
+	}
+	_ = f.Close()
+}
+
+// keepSocketFile stops a unix-domain listener removing its socket on close,
+// for when another process has taken over serving on it.
+func (fl *FingerListener) keepSocketFile() {
+	if ul, ok := fl.listener.(*net.UnixListener); ok {
+		ul.SetUnlinkOnClose(false)
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright © 2020 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// userFile is one of the files in a user's home-dir which we serve, in the
+// order listed.  A user only "exists" to finger if at least one of the files
+// marked required is present; fallback is sent in place of a file which
+// isn't there (or isn't valid).
+type userFile struct {
+	filename string
+	caption  string
+	required bool
+	fallback string
+}
+
+// The spec syntax is FILENAME:CAPTION[:FLAGS[:FALLBACK]] where FLAGS is a
+// comma-separated list; the only flag is "required".  The fallback is the
+// rest of the spec, so may contain colons.
+const userFileFlagRequired = "required"
+
+func parseUserFile(spec string) (userFile, error) {
+	parts := strings.SplitN(spec, ":", 4)
+	if len(parts) < 2 {
+		return userFile{}, fmt.Errorf("user-file %q: want FILENAME:CAPTION[:FLAGS[:FALLBACK]]", spec)
+	}
+	uf := userFile{filename: parts[0], caption: parts[1]}
+	if uf.filename == "" || uf.filename == "." || uf.filename == ".." || strings.ContainsAny(uf.filename, invalidInUsername) {
+		return userFile{}, fmt.Errorf("user-file %q: filename must be a plain name within the home-dir", spec)
+	}
+	if len(parts) > 2 {
+		for fl := range strings.SplitSeq(parts[2], ",") {
+			switch strings.TrimSpace(fl) {
+			case "":
+			case userFileFlagRequired:
+				uf.required = true
+			default:
+				return userFile{}, fmt.Errorf("user-file %q: unknown flag %q", spec, fl)
+			}
+		}
+	}
+	if len(parts) > 3 {
+		uf.fallback = parts[3]
+	}
+	return uf, nil
+}
+
+func (uf userFile) String() string {
+	s := uf.filename + ":" + uf.caption
+	if uf.required || uf.fallback != "" {
+		s += ":"
+		if uf.required {
+			s += userFileFlagRequired
+		}
+	}
+	if uf.fallback != "" {
+		s += ":" + uf.fallback
+	}
+	return s
+}
+
+// userFileList is a repeatable flag; the first use replaces the defaults.
+type userFileList struct {
+	files    []userFile
+	replaced bool
+}
+
+func (ul *userFileList) String() string {
+	if ul == nil {
+		return ""
+	}
+	return strings.Join(ul.List(), " ")
+}
+
+func (ul *userFileList) Set(value string) error {
+	uf, err := parseUserFile(value)
+	if err != nil {
+		return err
+	}
+	if !ul.replaced {
+		ul.files = nil
+		ul.replaced = true
+	}
+	ul.files = append(ul.files, uf)
+	return nil
+}
+
+func (ul *userFileList) SetList(values []string) error {
+	files := make([]userFile, 0, len(values))
+	for _, v := range values {
+		uf, err := parseUserFile(v)
+		if err != nil {
+			return err
+		}
+		files = append(files, uf)
+	}
+	ul.files = files
+	ul.replaced = true
+	return nil
+}
+
+func (ul *userFileList) List() []string {
+	out := make([]string, len(ul.files))
+	for i := range ul.files {
+		out[i] = ul.files[i].String()
+	}
+	return out
+}
+
+// The traditional set, as served before this was configurable.
+var userFiles = userFileList{files: []userFile{
+	{filename: ".project", caption: "Project", required: true},
+	{filename: ".plan", caption: "Plan", required: true, fallback: "No Plan."},
+	{filename: ".pubkey", caption: "Public key", required: true},
+}}
+
+func init() {
+	flag.Var(&userFiles, "user-file", "FILENAME:CAPTION[:required[:FALLBACK]] to serve from home-dirs, in order (repeat for each; replaces the default .project, .plan, .pubkey)")
+}
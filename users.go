@@ -20,6 +20,18 @@ type fingerUser struct {
 	homeDir    string
 	staticFile string
 	uid        uint32
+	anyOwner   bool // files' owner not checked, for some virtual homes
+
+	// Only for users found via passwd or LDAP
+	realName    string
+	gecosFields map[string]string
+	extraFields []userField
+}
+
+// userField is something shown about a user in /W mode.
+type userField struct {
+	caption string
+	value   string
 }
 
 var invalidInUsername = "\000/\\"
@@ -32,7 +44,7 @@ func init() {
 }
 
 // We don't enumerate ahead of time: /home could be an automount
-func findUser(username string, log logrus.FieldLogger) (fingerUser, bool) {
+func findUser(cfg *settings, username string, log logrus.FieldLogger) (fingerUser, bool) {
 
 	// We want to reject not just outright requests for filenames, but also
 	// attempts to break joining to `/home`, so `../etc/passwd`.  We thus reject
@@ -56,13 +68,16 @@ func findUser(username string, log logrus.FieldLogger) (fingerUser, bool) {
 	if strings.ContainsAny(username, invalidInUsername) {
 		return fingerUser{}, false
 	}
+	// Nor do `.` and `..` need a `/` to name a directory other than a user's
+	// own, once joined to the homes-dir or a virtual tree.
+	if username == "." || username == ".." {
+		return fingerUser{}, false
+	}
 
 	// Traditionally, we'd reject `@` to prevent remote host lookups, but
-	// that's when invoking an external `finger` command.  We don't implement
-	// remote host lookups, so don't need to prevent it.
-
-	redirect := currentAliases()
-	// pre-resolved, do not attempt to chase aliases-to-aliases
+	// that's when invoking an external `finger` command.  Our own forwarding
+	// (forward.go) takes such queries before we get here, if enabled, so we
+	// don't need to prevent it.
 
 	// If upper-case characters are in the username on-disk, we'll only work if
 	// the filesystem is case-insensitive.  If this bites you, please file a
@@ -71,46 +86,78 @@ func findUser(username string, log logrus.FieldLogger) (fingerUser, bool) {
 	// rationale even with a pull-request).
 	username = strings.ToLower(username)
 
-	if target, ok := redirect[username]; ok {
-		if target[0] == '/' {
-			return fingerUser{staticFile: target}, true
-		}
-		username = target
+	return resolveUser(&userQuery{cfg: cfg, username: username, log: log})
+}
+
+func init() {
+	registerResolver("aliases", resolverFunc(resolveAlias))
+	registerResolver("passwd", resolverFunc(resolvePasswd))
+	registerResolver("homes", resolverFunc(resolveHomesDir))
+}
+
+// authoritativeResolution maps the (ok, authoritative) returns of the passwd
+// style of lookup.
+func authoritativeResolution(ok, authoritative bool) resolution {
+	switch {
+	case !authoritative:
+		return resolveNext
+	case ok:
+		return resolveFound
 	}
+	return resolveDenied
+}
 
-	if opts.minPasswdUID != 0 {
-		f, ok, authoritative := findUserByPasswd(username, log)
-		if authoritative {
-			return f, ok
-		}
+func resolveAlias(q *userQuery) (fingerUser, resolution) {
+	// pre-resolved, do not attempt to chase aliases-to-aliases
+	target, ok := aliasesFor(q.cfg.aliasFile)[q.username]
+	if !ok {
+		return fingerUser{}, resolveNext
 	}
+	if target[0] == '/' {
+		q.log.WithField("static-file", target).Debug("alias to static file")
+		return fingerUser{staticFile: target}, resolveFound
+	}
+	q.log.WithField("target", target).Debug("alias to user")
+	q.username = target
+	return fingerUser{}, resolveNext
+}
 
-	// TODO: implement lookup by GECOS name?
-
-	if opts.homesDir != "" {
-		candidate := filepath.Join(opts.homesDir, username)
-		// users should not be able to rebind their home-dirs to be symlinks or whatever
-		fi, err := os.Lstat(candidate)
-		switch {
-		case err != nil:
-			// break out here if want other types of lookup even if homesDir is set
-			return fingerUser{}, false
-		case fi.IsDir():
-			stat, ok := fi.Sys().(*syscall.Stat_t)
-			if !ok {
-				log.WithField("dir", candidate).Warnf("bug in code for this platform: stat.Sys() not Stat_t but instead %T", fi.Sys())
-				return fingerUser{}, false
-			}
-			return fingerUser{homeStat: fi, homeDir: candidate, uid: stat.Uid}, true
-		default:
-			return fingerUser{}, false
-		}
+func resolvePasswd(q *userQuery) (fingerUser, resolution) {
+	if q.cfg.minPasswdUID == 0 {
+		return fingerUser{}, resolveNext
 	}
+	f, ok, authoritative := findUserByPasswd(q.cfg, q.username, q.log)
+	if !authoritative {
+		q.log.Debug("passwd lookup not authoritative, continuing")
+	}
+	return f, authoritativeResolution(ok, authoritative)
+}
 
-	return fingerUser{}, false
+func resolveHomesDir(q *userQuery) (fingerUser, resolution) {
+	if q.cfg.homesDir == "" {
+		return fingerUser{}, resolveNext
+	}
+	candidate := filepath.Join(q.cfg.homesDir, q.username)
+	// users should not be able to rebind their home-dirs to be symlinks or whatever
+	fi, err := os.Lstat(candidate)
+	switch {
+	case err != nil:
+		q.log.WithField("dir", candidate).Debug("no home-dir")
+		return fingerUser{}, resolveNext
+	case fi.IsDir():
+		stat, ok := fi.Sys().(*syscall.Stat_t)
+		if !ok {
+			q.log.WithField("dir", candidate).Warnf("bug in code for this platform: stat.Sys() not Stat_t but instead %T", fi.Sys())
+			return fingerUser{}, resolveDenied
+		}
+		q.log.WithField("dir", candidate).Debug("found home-dir")
+		return fingerUser{homeStat: fi, homeDir: candidate, uid: stat.Uid}, resolveFound
+	}
+	q.log.WithField("dir", candidate).Debug("home-dir not a directory")
+	return fingerUser{}, resolveDenied
 }
 
-func findUserByPasswd(username string, log logrus.FieldLogger) (
+func findUserByPasswd(cfg *settings, username string, log logrus.FieldLogger) (
 	result fingerUser,
 	ok bool,
 	authoritative bool,
@@ -128,15 +175,26 @@ func findUserByPasswd(username string, log logrus.FieldLogger) (
 		return fingerUser{}, false, false
 	}
 
-	if uid64 < opts.minPasswdUID {
+	if uid64 < cfg.minPasswdUID {
 		return fingerUser{}, false, true
 	}
 
-	uid := uint32(uid64)
+	result, ok, authoritative = passwdUserHome(uint32(uid64), u.HomeDir, log)
+	if ok {
+		result.realName, result.gecosFields = passwdAccountInfo(u.Username, uid64, u.Name)
+	}
+	return result, ok, authoritative
+}
 
+// passwdUserHome finishes a passwd lookup, from whichever source.
+func passwdUserHome(uid uint32, homeDir string, log logrus.FieldLogger) (
+	result fingerUser,
+	ok bool,
+	authoritative bool,
+) {
 	// Here we do allow symlinks, if that's explicitly what's listed in /etc/passwd.
 	// Ugh.
-	fi, err := os.Stat(u.HomeDir)
+	fi, err := os.Stat(homeDir)
 	switch {
 	case err != nil:
 		log.WithError(err).Info("passwd user homedir won't stat")
@@ -146,12 +204,12 @@ func findUserByPasswd(username string, log logrus.FieldLogger) (
 		// authoritative for what the ownership of the files within needs to
 		// be.
 		return fingerUser{
-			homeDir:  u.HomeDir,
+			homeDir:  homeDir,
 			uid:      uid,
 			homeStat: fi,
 		}, true, true
 	}
-	log.WithField("not-dir", u.HomeDir).WithField("mode", fi.Mode().String()).Warn("passwd user homedir not a directory")
+	log.WithField("not-dir", homeDir).WithField("mode", fi.Mode().String()).Warn("passwd user homedir not a directory")
 	return fingerUser{}, false, false
 
 }
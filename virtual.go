@@ -0,0 +1,136 @@
+// Copyright © 2020 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Virtual homes are for role accounts and people without a login here: a
+// directory tree like /srv/finger/<name>/.plan, served just like a home-dir
+// but with the files' expected owner given per tree, rather than being the
+// user's.  An owner of "any" turns the ownership checks off for that tree,
+// for content deployed by tooling which doesn't preserve owners; then anyone
+// who can write into the tree can publish there, so it's on the operator to
+// keep it locked down.  Nor, then, is there an owner check to stop a symlink
+// pointing anywhere we can read, so the files must not be symlinks.
+//
+// As with the homes-dir, the <name> entry must be a real directory, not a
+// symlink; the first tree with an entry for the name is the only one used.
+
+const virtualOwnerAny = "any"
+
+type virtualHome struct {
+	dir      string
+	owner    string
+	uid      uint32
+	anyOwner bool
+}
+
+func parseVirtualHome(spec string) (virtualHome, error) {
+	i := strings.LastIndexByte(spec, ':')
+	if i < 0 {
+		return virtualHome{}, fmt.Errorf("virtual-home %q: want DIR:OWNER", spec)
+	}
+	vh := virtualHome{dir: spec[:i], owner: spec[i+1:]}
+	if !filepath.IsAbs(vh.dir) {
+		return virtualHome{}, fmt.Errorf("virtual-home %q: directory not absolute", spec)
+	}
+	vh.dir = filepath.Clean(vh.dir)
+	switch vh.owner {
+	case "":
+		return virtualHome{}, fmt.Errorf("virtual-home %q: missing owner (use %q to not check)", spec, virtualOwnerAny)
+	case virtualOwnerAny:
+		vh.anyOwner = true
+		return vh, nil
+	}
+	uid, err := strconv.ParseUint(vh.owner, 10, 32)
+	if err != nil {
+		u, lerr := user.Lookup(vh.owner)
+		if lerr != nil {
+			return virtualHome{}, fmt.Errorf("virtual-home %q: %w", spec, lerr)
+		}
+		if uid, err = strconv.ParseUint(u.Uid, 10, 32); err != nil {
+			return virtualHome{}, fmt.Errorf("virtual-home %q: owner uid %q: %w", spec, u.Uid, err)
+		}
+	}
+	if uid == 0 {
+		// Zero means "no check" to parts of the file-serving code.
+		return virtualHome{}, fmt.Errorf("virtual-home %q: owner must not be root", spec)
+	}
+	vh.uid = uint32(uid)
+	return vh, nil
+}
+
+func (vh virtualHome) String() string {
+	return vh.dir + ":" + vh.owner
+}
+
+// virtualHomeList is a repeatable flag, searched in order.
+type virtualHomeList []virtualHome
+
+func (vl *virtualHomeList) String() string {
+	if vl == nil {
+		return ""
+	}
+	return strings.Join(vl.List(), " ")
+}
+
+func (vl *virtualHomeList) Set(value string) error {
+	vh, err := parseVirtualHome(value)
+	if err != nil {
+		return err
+	}
+	*vl = append(*vl, vh)
+	return nil
+}
+
+func (vl *virtualHomeList) SetList(values []string) error {
+	out := make(virtualHomeList, 0, len(values))
+	for _, v := range values {
+		vh, err := parseVirtualHome(v)
+		if err != nil {
+			return err
+		}
+		out = append(out, vh)
+	}
+	*vl = out
+	return nil
+}
+
+func (vl *virtualHomeList) List() []string {
+	out := make([]string, len(*vl))
+	for i := range *vl {
+		out[i] = (*vl)[i].String()
+	}
+	return out
+}
+
+func init() {
+	registerResolver("virtual", resolverFunc(resolveVirtualHome))
+}
+
+func resolveVirtualHome(q *userQuery) (fingerUser, resolution) {
+	for _, vh := range q.cfg.virtualHomes {
+		candidate := filepath.Join(vh.dir, q.username)
+		log := q.log.WithField("dir", candidate)
+		fi, err := os.Lstat(candidate)
+		switch {
+		case err != nil:
+			continue
+		case !fi.IsDir():
+			log.Debug("virtual home not a directory")
+			return fingerUser{}, resolveDenied
+		}
+		log.Debug("found virtual home")
+		return fingerUser{homeStat: fi, homeDir: candidate, uid: vh.uid, anyOwner: vh.anyOwner}, resolveFound
+	}
+	return fingerUser{}, resolveNext
+}
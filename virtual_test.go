@@ -0,0 +1,120 @@
+// Copyright © 2020 Pennock Tech, LLC.
+// All rights reserved, except as granted under license.
+// Licensed per file LICENSE.txt
+
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Repeating -virtual-home on the command-line must survive a settings
+// rebuild, which is every startup and SIGHUP.
+func TestBuildSettingsRepeatedVirtualHome(t *testing.T) {
+	fv := flag.Lookup("virtual-home").Value.(listValue)
+	saved := fv.List()
+	defer func() {
+		_ = fv.SetList(saved)
+		delete(commandLineFlags, "virtual-home")
+	}()
+
+	specs := []string{"/srv/finger/one:any", "/srv/finger/two:any"}
+	_ = fv.SetList(nil)
+	for _, spec := range specs {
+		if err := flag.Set("virtual-home", spec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	commandLineFlags["virtual-home"] = true
+
+	cfg, err := buildSettings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cfg.virtualHomes.List(); !reflect.DeepEqual(got, specs) {
+		t.Fatalf("virtual homes %q, want %q", got, specs)
+	}
+}
+
+func TestFindUserDotNames(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = io.Discard
+	log := logrus.NewEntry(logger)
+
+	top := t.TempDir()
+	homes := filepath.Join(top, "homes")
+	virt := filepath.Join(homes, "virt")
+	if err := os.MkdirAll(virt, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	cfg := *currentSettings()
+	cfg.aliasFile = ""
+	cfg.homesDir = homes
+	cfg.virtualHomes = virtualHomeList{{dir: virt, owner: virtualOwnerAny, anyOwner: true}}
+	_ = cfg.resolvers.SetList([]string{"homes", "virtual"})
+
+	for _, name := range []string{".", ".."} {
+		if u, ok := findUser(&cfg, name, log); ok {
+			t.Errorf("%q found, as %q", name, u.homeDir)
+		}
+	}
+	if _, ok := findUser(&cfg, "virt", log); !ok {
+		t.Error("plain name not found")
+	}
+}
+
+// Where the owner isn't checked, user files which are symlinks are refused,
+// however they're reached.
+func TestVirtualHomeAnyOwnerSymlinks(t *testing.T) {
+	top := t.TempDir()
+	secret := filepath.Join(top, "secret")
+	home := filepath.Join(top, "virt", "bob")
+	if err := os.MkdirAll(home, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for name, contents := range map[string]string{
+		secret:                          "not for publication\n",
+		filepath.Join(home, ".project"): "Finger\n",
+	} {
+		if err := os.WriteFile(name, []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(secret, filepath.Join(home, ".plan")); err != nil {
+		t.Fatal(err)
+	}
+
+	c, conn := testConnection(t, "bob\r\n")
+	c.cfg.virtualHomes = virtualHomeList{{dir: filepath.Dir(home), owner: virtualOwnerAny, anyOwner: true}}
+	_ = c.cfg.resolvers.SetList([]string{"virtual"})
+	c.serveRequest()
+	response := conn.response.String()
+	if strings.Contains(response, "not for publication") {
+		t.Fatalf("followed a symlink: %q", response)
+	}
+	if !strings.Contains(response, "Project: Finger") || !strings.Contains(response, "No Plan.") {
+		t.Fatalf("unexpected response: %q", response)
+	}
+
+	// and if the stat was fooled, the open isn't
+	c, conn = testConnection(t, "")
+	c.homeDir = home
+	c.anyOwner = true
+	if n := c.sendFile(".plan", "Plan"); n != 0 || conn.response.Len() != 0 {
+		t.Fatalf("sent %q", conn.response.String())
+	}
+	if got := c.readSmallHomeFile(".plan", 1024); got != nil {
+		t.Fatalf("read %q", got)
+	}
+	if got := c.readSmallHomeFile(".project", 1024); string(got) != "Finger\n" {
+		t.Fatalf("regular file read as %q", got)
+	}
+}